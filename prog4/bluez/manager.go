@@ -3,7 +3,6 @@ package bluez
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -11,9 +10,21 @@ import (
 	"github.com/godbus/dbus"
 	"github.com/godbus/dbus/introspect"
 	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
 )
 
+var log = jclog.New("bluez")
+
+// devLog returns a logger for messages about one device.
+func devLog(path dbus.ObjectPath) *jclog.Logger {
+	var notify jcpc.BluetoothDeviceNotification
+	if parseMACPath(&notify, path) {
+		return log.With("mac", notify.MACString)
+	}
+	return log.With("path", path)
+}
+
 // JoyconAPI presents a manageable surface area for the rest of the code to
 // use.  Eventually it will be turned into an interface for multi-OS
 // functionality.
@@ -28,6 +39,12 @@ type JoyconAPI struct {
 	discoveryEnabled bool
 	adapterPaths     []dbus.ObjectPath
 	devicePaths      map[dbus.ObjectPath]btDeviceInfo
+	autoReconnect    bool
+	// nil while the reconnect loop is not running
+	reconnectStop chan struct{}
+	reconnect     map[dbus.ObjectPath]*reconnectState
+	// MAC string -> disconnected by the user, see UserDisconnected
+	userDisconnected map[string]bool
 
 	setupDone         bool
 	setupChangeBuffer []*dbus.Signal
@@ -72,6 +89,9 @@ func New() (*JoyconAPI, error) {
 		busConn:      busConn,
 		busSignalCh:  signalCh,
 		devicePaths:  make(map[dbus.ObjectPath]btDeviceInfo),
+
+		autoReconnect:    true,
+		userDisconnected: make(map[string]bool),
 	}
 	go a.handleChangeSignals()
 	return a, nil
@@ -82,7 +102,7 @@ func New() (*JoyconAPI, error) {
 func (a *JoyconAPI) StartDiscovery() {
 	err := a.startDiscovery()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\r[bluez] failed to start bluetooth discovery: %v\n", err)
+		log.Warnf("failed to start bluetooth discovery: %v", err)
 	}
 }
 
@@ -95,7 +115,7 @@ func (a *JoyconAPI) startDiscovery() error {
 	adapterList := a.adapterPaths
 	a.mu.Unlock()
 
-	fmt.Println("[bluez] starting bt discovery")
+	log.Infof("starting bt discovery")
 	// Request discovery from every adapter
 	ch := make(chan *dbus.Call, len(adapterList))
 	for _, path := range adapterList {
@@ -104,8 +124,8 @@ func (a *JoyconAPI) startDiscovery() error {
 	for _ = range adapterList {
 		call := <-ch
 		if call.Err != nil {
-			fmt.Fprintf(os.Stderr,
-				"\r[bluez] failed to start bluetooth discovery for %s: %v\n",
+			log.Warnf(
+				"failed to start bluetooth discovery for %s: %v",
 				strings.TrimPrefix(string(call.Path), "/org/bluez/"),
 				call.Err,
 			)
@@ -135,8 +155,8 @@ func (a *JoyconAPI) connectAllDevices() {
 		for _ = range deviceList {
 			call := <-ch
 			if call.Err != nil {
-				fmt.Fprintf(os.Stderr,
-					"\r[bluez] [INFO] failed to connect bluetooth device %s: %v\n",
+				log.Infof(
+					"failed to connect bluetooth device %s: %v",
 					strings.TrimPrefix(string(call.Path), "/org/bluez/"),
 					call.Err,
 				)
@@ -150,33 +170,33 @@ func (a *JoyconAPI) connectAllDevices() {
 
 // Same as above, but only one device. Use 'go' when calling.
 func (a *JoyconAPI) tryConnectDevice(path dbus.ObjectPath) {
-	fmt.Println("[bluez] attempting connect to", path)
+	devLog(path).Debugf("attempting connect")
 	call := a.busConn.Object(BlueZBusName, path).Call("org.bluez.Device1.ConnectProfile", 0, HIDProfileUUIDStrU)
 	if call.Err != nil {
-		fmt.Fprintf(os.Stderr,
-			"\r[bluez] [INFO] failed to connect bluetooth device %s: %v\n",
+		log.Infof(
+			"failed to connect bluetooth device %s: %v",
 			strings.TrimPrefix(string(call.Path), "/org/bluez/"),
 			call.Err,
 		)
 	} else {
 		// should get signal notified
 		//a.checkDevice(call.Path)
-		fmt.Println("[bluez] connect success to", path)
+		devLog(path).Infof("connect success")
 	}
 }
 
 func (a *JoyconAPI) tryPairDevice(path dbus.ObjectPath) {
-	fmt.Println("[bluez] attempting pair with", path)
+	devLog(path).Debugf("attempting pair")
 	call := a.busConn.Object(BlueZBusName, path).Call("org.bluez.Device1.Pair", 0)
 	if call.Err != nil {
-		fmt.Fprintf(os.Stderr,
-			"\r[bluez] [INFO] failed to pair bluetooth device %s: %v\n",
+		log.Infof(
+			"failed to pair bluetooth device %s: %v",
 			strings.TrimPrefix(string(call.Path), "/org/bluez/"),
 			call.Err,
 		)
 	} else {
 		//a.checkDevice(call.Path)
-		fmt.Println("[bluez] pair success to", path)
+		devLog(path).Infof("pair success")
 	}
 }
 
@@ -184,7 +204,7 @@ func (a *JoyconAPI) tryPairDevice(path dbus.ObjectPath) {
 func (a *JoyconAPI) StopDiscovery() {
 	err := a.stopDiscovery()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\r[bluez] failed to stop bluetooth discovery: %v\n", err)
+		log.Warnf("failed to stop bluetooth discovery: %v", err)
 	}
 }
 
@@ -197,7 +217,7 @@ func (a *JoyconAPI) stopDiscovery() error {
 	adapterList := a.adapterPaths
 	a.mu.Unlock()
 
-	fmt.Println("[bluez] stopping bt discovery")
+	log.Infof("stopping bt discovery")
 	// Request discovery from every adapter
 	ch := make(chan *dbus.Call, len(adapterList))
 	for _, path := range adapterList {
@@ -206,8 +226,8 @@ func (a *JoyconAPI) stopDiscovery() error {
 	for _ = range adapterList {
 		call := <-ch
 		if call.Err != nil {
-			fmt.Fprintf(os.Stderr,
-				"\r[bluez] failed to start bluetooth discovery for %s: %v\n",
+			log.Warnf(
+				"failed to stop bluetooth discovery for %s: %v",
 				strings.TrimPrefix(string(call.Path), "/org/bluez/"),
 				call.Err,
 			)
@@ -228,21 +248,53 @@ func (a *JoyconAPI) NotifyChannel() <-chan jcpc.BluetoothDeviceNotification {
 }
 
 // Call this when the user holds the device sync button down.
-func (a *JoyconAPI) DeletePairingInfo() {
-	err := a.deletePairingInfo()
+func (a *JoyconAPI) DeletePairingInfo(mac string) ([]string, error) {
+	removed, err := a.deletePairingInfo(mac)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\r[bluez] failed to delete pairing info: %v\n", err)
+		log.Warnf("failed to delete pairing info: %v", err)
 	}
+	return removed, err
 }
 
-func (a *JoyconAPI) deletePairingInfo() error {
-	// TODO
-	// listBluetoothDevices()
-	// for dev := devices
-	// if isJoyCon(dev)
-	// getAdapter(dev.adapter).RemoveDevice(path)
-	fmt.Println("[bluez] [ERR] DeletePairingInfo: NOT IMPLEMENTED")
-	return nil
+// deletePairingInfo removes the known Joy-Cons, or the device with the given
+// MAC address, from their adapters.
+func (a *JoyconAPI) deletePairingInfo(mac string) ([]string, error) {
+	mac = strings.ToUpper(strings.NewReplacer("_", ":", "-", ":").Replace(mac))
+
+	var paths []dbus.ObjectPath
+	var macs []string
+	a.mu.Lock()
+	for path, info := range a.devicePaths {
+		var notify jcpc.BluetoothDeviceNotification
+		if !parseMACPath(&notify, path) {
+			continue
+		}
+		if mac == "" && info.IsJoyCon || mac != "" && notify.MACString == mac {
+			paths = append(paths, path)
+			macs = append(macs, notify.MACString)
+		}
+	}
+	a.mu.Unlock()
+	if mac != "" && len(paths) == 0 {
+		return nil, errors.Errorf("no bluetooth device %s", mac)
+	}
+
+	var removed, failed []string
+	for i, path := range paths {
+		adapter := dbus.ObjectPath(path[:strings.LastIndex(string(path), "/")])
+		call := a.busConn.Object(BlueZBusName, adapter).Call("org.bluez.Adapter1.RemoveDevice", 0, path)
+		if call.Err != nil {
+			devLog(path).Warnf("failed to remove device: %v", call.Err)
+			failed = append(failed, fmt.Sprintf("%s: %v", macs[i], call.Err))
+			continue
+		}
+		devLog(path).Infof("removed pairing record")
+		removed = append(removed, macs[i])
+	}
+	if len(failed) > 0 {
+		return removed, errors.Errorf("could not remove %s", strings.Join(failed, ", "))
+	}
+	return removed, nil
 }
 
 // marks the device as Trusted
@@ -265,14 +317,14 @@ func (a *JoyconAPI) savePairingInfo(macStr string) {
 	}
 	a.mu.Unlock()
 	if len(paths) == 0 {
-		fmt.Fprintf(os.Stderr, "\r[bluez] failed to save bluetooth pairing info for %s: device not found\n", macStr)
+		log.Warnf("failed to save bluetooth pairing info for %s: device not found", macStr)
 		return
 	}
 	for _, path := range paths {
 		obj := a.busConn.Object(BlueZBusName, path)
 		c := obj.Call("org.freedesktop.DBus.Properties.Set", 0, "org.bluez.Device1", "Trusted", true)
 		if c.Err != nil {
-			fmt.Fprintf(os.Stderr, "\r[bluez] failed to save bluetooth pairing info for %s: %v\n", path, c.Err)
+			log.Warnf("failed to save bluetooth pairing info for %s: %v", path, c.Err)
 		}
 	}
 }
@@ -280,12 +332,12 @@ func (a *JoyconAPI) savePairingInfo(macStr string) {
 func (a *JoyconAPI) InitialScan() {
 	err := a.initialScan()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\r[bluez] failed to check bluetooth devices: %v\n", err)
+		log.Warnf("failed to check bluetooth devices: %v", err)
 	}
 }
 
 func (a *JoyconAPI) initialScan() error {
-	fmt.Println("Starting initial scan")
+	log.Debugf("starting initial scan")
 	// Subscribe to InterfaceAdded/InterfaceRemoved
 	busObj := a.busConn.BusObject()
 	sigCall := busObj.Call("org.freedesktop.DBus.AddMatch", 0,
@@ -301,7 +353,7 @@ func (a *JoyconAPI) initialScan() error {
 	if sigCall.Err != nil {
 		return errors.Wrap(sigCall.Err, "subscribe to updates")
 	}
-	fmt.Println("done with addmatchsignal")
+	log.Debugf("done with addmatchsignal")
 
 	// Call GetManagedObjects
 	obj := a.busConn.Object(BlueZBusName, "/")
@@ -322,6 +374,9 @@ func (a *JoyconAPI) initialScan() error {
 
 	a.mu.Lock()
 	a.setupDone = true
+	if a.autoReconnect {
+		a.startReconnectLoop()
+	}
 	a.mu.Unlock()
 
 	return nil
@@ -340,11 +395,11 @@ func (a *JoyconAPI) initialScan() error {
 		a.adapterPaths = adapterList
 		a.mu.Unlock()
 
-		fmt.Println("[bluez] adapter check: found", len(adapterList))
+		log.Debugf("adapter check: found %d", len(adapterList))
 		for _, v := range adapterList {
 			err = a.checkAdapter(v)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "\r[bluez] failed to check bluetooth devices under %s: %v\n", v, err)
+				log.Warnf( "failed to check bluetooth devices under %s: %v", v, err)
 			}
 		}
 		return nil
@@ -358,20 +413,20 @@ func (a *JoyconAPI) handleChangeSignals() {
 			var data dbusObjectNotify
 			err := dbus.Store(busSig.Body, &path, &data)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "\r[bluez] failed to process InterfacesAdded message: %v\n%v\n", err, busSig)
+				log.Warnf("failed to process InterfacesAdded message: %v %v", err, busSig)
 				continue
 			}
-			fmt.Println("[bluez] [DEBUG] InterfacesAdded", path, data)
+			log.Debugf("InterfacesAdded %v %v", path, data)
 			go a.checkDBusNewObject(path, data)
 		} else if busSig.Name == "org.freedesktop.DBus.ObjectManager.InterfacesRemoved" {
 			var path dbus.ObjectPath
 			var ifaces []string
 			err := dbus.Store(busSig.Body, &path, &ifaces)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "\r[bluez] failed to process InterfacesRemoved message: %v\n%v\n", err, busSig)
+				log.Warnf("failed to process InterfacesRemoved message: %v %v", err, busSig)
 				continue
 			}
-			fmt.Println("[bluez] [DEBUG] InterfacesRemoved", path, ifaces)
+			log.Debugf("InterfacesRemoved %v %v", path, ifaces)
 			go a.processRemoval(path, ifaces)
 		} else if busSig.Name == "org.freedesktop.DBus.Properties.PropertiesChanged" {
 			var path dbus.ObjectPath
@@ -381,14 +436,14 @@ func (a *JoyconAPI) handleChangeSignals() {
 			path = busSig.Path
 			err := dbus.Store(busSig.Body, &iface, &changed, &invalidated)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "\r[bluez] failed to process PropertiesChanged message: %v\n%v\n", err, busSig)
+				log.Warnf("failed to process PropertiesChanged message: %v %v", err, busSig)
 				continue
 			}
-			fmt.Println("[bluez] [DEBUG] PropertiesChanged", path, iface, changed, invalidated)
+			log.Debugf("PropertiesChanged %v %v %v %v", path, iface, changed, invalidated)
 			// TODO
 			go a.checkProperties(path, iface, changed, invalidated)
 		} else {
-			fmt.Println("[bluez]", "unhandled dbus signal", busSig)
+			log.Debugf("unhandled dbus signal %v", busSig)
 		}
 	}
 }
@@ -408,11 +463,11 @@ func (a *JoyconAPI) checkDBusNewObject(path dbus.ObjectPath, data dbusObjectNoti
 			a.adapterPaths = append(a.adapterPaths, path)
 		}
 		a.mu.Unlock()
-		fmt.Println("[bluez] found adapter", path)
+		log.Infof("found adapter %v", path)
 	}
 	deviceData, ok := data[Device1Interface]
 	if ok {
-		fmt.Println("[bluez] found device", path, deviceData)
+		devLog(path).Debugf("found device %v", deviceData)
 		a.checkDevice(path)
 	}
 }
@@ -433,18 +488,19 @@ func (a *JoyconAPI) processRemoval(path dbus.ObjectPath, ifaces []string) {
 				a.adapterPaths = a.adapterPaths[:len(a.adapterPaths)-1]
 			}
 			a.mu.Unlock()
-			fmt.Println("[bluez] removed adapter", path)
+			log.Infof("removed adapter %v", path)
 		}
 		if iface == Device1Interface {
 			a.mu.Lock()
 			devInfo := a.devicePaths[path]
+			delete(a.devicePaths, path)
 			a.mu.Unlock()
 
 			if devInfo.IsJoyCon {
 				a.emitNotify(path, false, false)
-				fmt.Println("[bluez] removed joy-con", path)
+				devLog(path).Infof("removed joy-con")
 			} else {
-				fmt.Println("[bluez] ignored device removal", path)
+				devLog(path).Debugf("ignored device removal")
 			}
 		}
 	}
@@ -460,7 +516,7 @@ func (a *JoyconAPI) checkProperties(path dbus.ObjectPath, iface string, changed
 func (a *JoyconAPI) emitNotify(path dbus.ObjectPath, connected, newDevice bool) {
 	var notify jcpc.BluetoothDeviceNotification
 	if !parseMACPath(&notify, path) {
-		fmt.Println("[bluez] [ERR] could not parse device MAC", path)
+		log.Errorf("could not parse device MAC %v", path)
 		return
 	}
 	notify.Connected = connected
@@ -505,18 +561,18 @@ func (a *JoyconAPI) checkAdapter(path dbus.ObjectPath, data dbusObjectNotify) er
 	if adapterAddr, ok := adapterAddrV.Value().(string); ok {
 		// check adapter vs blacklist
 		_ = adapterAddr
-		fmt.Println("[bluez]", "adapter check:", "found", path, adapterAddr)
+		log.Debugf("adapter check: found %v %s", path, adapterAddr)
 	} else {
-		fmt.Printf("[bluez] adapter check: addr not a string, got %T %v\n", adapterAddrV.Value(), adapterAddrV.Value())
+		log.Warnf("adapter check: addr not a string, got %T %v", adapterAddrV.Value(), adapterAddrV.Value())
 	}
 
-	fmt.Println("[bluez] introspect", obj)
+	log.Debugf("introspect %v", obj)
 	ispectNode, err := introspect.Call(obj)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\r[dbus] failed to check bluetooth devices: introspect %s: %v\n", path, err)
+		log.Warnf("failed to check bluetooth devices: introspect %s: %v", path, err)
 		return err
 	}
-	fmt.Println("[bluez] introspect found", len(ispectNode.Children), "device records")
+	log.Debugf("introspect found %d device records", len(ispectNode.Children))
 	for _, v := range ispectNode.Children {
 		a.checkDevice(joinPath(path, v.Name))
 	}
@@ -530,34 +586,41 @@ func (a *JoyconAPI) checkDevice(path dbus.ObjectPath) {
 
 	info, err := a.getDeviceInfo(path)
 	if err != nil {
-		fmt.Println("[bluez]", "device", path, "error", err)
+		devLog(path).Warnf("getting device info: %v", err)
 	} else {
 		a.mu.Lock()
 		a.devicePaths[path] = info
 		isDiscovering := a.discoveryEnabled
+		if info.Connected && !prevInfo.Connected {
+			// connected by itself, reconnect it again after it drops
+			var notify jcpc.BluetoothDeviceNotification
+			if parseMACPath(&notify, path) {
+				delete(a.userDisconnected, notify.MACString)
+			}
+		}
 		a.mu.Unlock()
 
 		if !info.IsJoyCon {
 			return
 		}
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		fmt.Println("[bluez]", "device", path, "info")
-		enc.Encode(info)
+		if log.Enabled(jclog.LevelDebug) {
+			p, _ := json.MarshalIndent(info, "", "  ")
+			devLog(path).Debugf("device info\n%s", p)
+		}
 
 		if prevInfo.Connected != info.Connected {
-			fmt.Println("[bluez] [info] notifying ui of connection state")
+			devLog(path).Debugf("notifying ui of connection state")
 			// definition of "new controller" -- i.e. needs L+R press -- is !Trusted
 			a.emitNotify(path, info.Connected, true)
 		}
 		if isDiscovering && prevInfo.IsJoyCon != info.IsJoyCon {
 			// This is a new device
-			fmt.Println("[bluez] checkDevice: attempt pair?", path)
+			devLog(path).Debugf("checkDevice: attempt pair?")
 			a.tryPairDevice(path)
 		}
 		if prevInfo.Paired != info.Paired && info.Paired {
 			// Just completed pairing, autoconnect
-			fmt.Println("[bluez] checkDevice: just paired, doing connect", path)
+			devLog(path).Debugf("checkDevice: just paired, doing connect")
 			a.tryConnectDevice(path)
 		}
 	}
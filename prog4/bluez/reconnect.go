@@ -0,0 +1,155 @@
+package bluez
+
+import (
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+const (
+	reconnectCheckInterval = 1 * time.Second
+	reconnectMinBackoff    = 2 * time.Second
+	reconnectMaxBackoff    = 2 * time.Minute
+)
+
+// reconnectState is the backoff of a trusted Joy-Con that is not connected.
+type reconnectState struct {
+	next     time.Time
+	backoff  time.Duration
+	inFlight bool
+}
+
+// SetAutoReconnect turns the background reconnect loop on or off.
+func (a *JoyconAPI) SetAutoReconnect(enabled bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.autoReconnect = enabled
+	if enabled && a.setupDone {
+		a.startReconnectLoop()
+	} else if !enabled {
+		a.stopReconnectLoop()
+	}
+	return nil
+}
+
+func (a *JoyconAPI) AutoReconnect() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.autoReconnect
+}
+
+// UserDisconnected keeps the reconnect loop away from a Joy-Con that the
+// user disconnected, until it connects again by itself.
+func (a *JoyconAPI) UserDisconnected(mac string) {
+	mac = strings.ToUpper(strings.NewReplacer("_", ":", "-", ":").Replace(mac))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.userDisconnected[mac] = true
+	log.With("mac", mac).Debugf("not reconnecting until the controller connects by itself")
+}
+
+// mu must be held
+func (a *JoyconAPI) startReconnectLoop() {
+	if a.reconnectStop != nil {
+		return
+	}
+	a.reconnectStop = make(chan struct{})
+	a.reconnect = make(map[dbus.ObjectPath]*reconnectState)
+	go a.reconnectLoop(a.reconnectStop)
+	log.Infof("automatic reconnect on")
+}
+
+// mu must be held
+func (a *JoyconAPI) stopReconnectLoop() {
+	if a.reconnectStop == nil {
+		return
+	}
+	close(a.reconnectStop)
+	a.reconnectStop = nil
+	log.Infof("automatic reconnect off")
+}
+
+func (a *JoyconAPI) reconnectLoop(stop chan struct{}) {
+	ticker := time.NewTicker(reconnectCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			a.reconnectDue(now)
+		}
+	}
+}
+
+// reconnectDue starts a connection attempt for each trusted Joy-Con whose
+// backoff has passed.
+func (a *JoyconAPI) reconnectDue(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.reconnectStop == nil {
+		return
+	}
+	for path := range a.reconnect {
+		info, ok := a.devicePaths[path]
+		if !ok || info.Connected {
+			delete(a.reconnect, path)
+		}
+	}
+	for path, info := range a.devicePaths {
+		if !info.IsJoyCon || !info.Paired || !info.Trusted || info.Connected {
+			continue
+		}
+		var notify jcpc.BluetoothDeviceNotification
+		if parseMACPath(&notify, path) && a.userDisconnected[notify.MACString] {
+			continue
+		}
+		st := a.reconnect[path]
+		if st == nil {
+			st = &reconnectState{next: now, backoff: reconnectMinBackoff}
+			a.reconnect[path] = st
+		}
+		if st.inFlight || now.Before(st.next) {
+			continue
+		}
+		st.inFlight = true
+		go a.tryReconnect(path, st)
+	}
+}
+
+// tryReconnect calls Device1.Connect and schedules the next attempt.
+func (a *JoyconAPI) tryReconnect(path dbus.ObjectPath, st *reconnectState) {
+	lg := devLog(path)
+	lg.Debugf("attempting reconnect")
+	call := a.busConn.Object(BlueZBusName, path).Call("org.bluez.Device1.Connect", 0)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st.inFlight = false
+	err := call.Err
+	switch {
+	case err == nil:
+		lg.Infof("reconnected")
+		st.backoff = reconnectMinBackoff
+	case strings.Contains(err.Error(), "device busy"):
+		// already connected, or another attempt is running
+		lg.Debugf("reconnect: %v", err)
+		st.backoff = reconnectMinBackoff
+	case strings.Contains(err.Error(), "(36)"):
+		// out of range or asleep, the usual case
+		lg.Debugf("reconnect: %v", err)
+		st.backoff *= 2
+	default:
+		lg.Infof("reconnect failed: %v", err)
+		st.backoff *= 2
+	}
+	if st.backoff > reconnectMaxBackoff {
+		st.backoff = reconnectMaxBackoff
+	}
+	st.next = time.Now().Add(st.backoff)
+}
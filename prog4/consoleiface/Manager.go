@@ -4,28 +4,43 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/GeertJohan/go.hid"
+	"github.com/chzyer/readline"
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/control"
 	"github.com/riking/joycon/prog4/controller"
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
 	"github.com/riking/joycon/prog4/joycon"
+	"github.com/riking/joycon/prog4/output"
 )
 
-const maxControllerCount = 4
+var log = jclog.New("manager")
+
+const maxControllerCount = 8
+
+// How long a JoyCon of a remembered pair waits for its partner to connect
+// before it has to be paired by hand.
+const groupWaitTimeout = 30 * time.Second
 
 type outputController struct {
-	pNum int
-	c    jcpc.Controller
-	o    jcpc.Output
-	jc   []jcpc.JoyCon
+	pNum   int
+	c      jcpc.Controller
+	o      jcpc.Output
+	filter *output.Filter
+	jc     []jcpc.JoyCon
 }
 
 type unpairedController struct {
 	jc          jcpc.JoyCon
 	curButtons  jcpc.ButtonState
 	prevButtons jcpc.ButtonState
+	// set while waiting for the partner of a remembered pair
+	waitUntil time.Time
 }
 
 type Manager struct {
@@ -37,10 +52,31 @@ type Manager struct {
 
 	outputFactory jcpc.OutputFactory
 	btManager     jcpc.BluetoothManager
+	watchers      []jcpc.Watcher
+	// player lights set by the host, by output
+	hostLights map[jcpc.Output]byte
+	// set while the watch command is running
+	dashboard *dashboard
+	// receives events if the control socket is enabled
+	control *control.Server
+	hooks   []*hook
+	// JoyCons that ran the low-battery hooks and have not been charged since
+	lowBattery map[jcpc.JoyCon]bool
+	// buttons held on each controller, for chord hooks
+	chordButtons map[jcpc.Controller]jcpc.ButtonState
+	// low battery alerts, by battery level
+	alertConfigs [lowBatteryLevel + 1]alertConfig
+	alerts       map[jcpc.JoyCon]*batteryAlert
+
+	statePath string
+	state     savedState
 
 	commandChan      chan string
 	attemptPairingCh chan struct{}
 	consoleExit      chan struct{}
+	stopOnce         sync.Once
+	// don't read commands from stdin
+	noConsole bool
 
 	// flags to set for the main loop
 	doAttemptPairing bool
@@ -52,6 +88,12 @@ func New(of jcpc.OutputFactory, bt jcpc.BluetoothManager, opts jcpc.Options) *Ma
 	m := &Manager{
 		outputFactory: of,
 		btManager:     bt,
+		hostLights:    make(map[jcpc.Output]byte),
+		hooks:         newHooks(opts.Hooks),
+		lowBattery:    make(map[jcpc.JoyCon]bool),
+		chordButtons:  make(map[jcpc.Controller]jcpc.ButtonState),
+		alertConfigs:  newAlertConfigs(opts),
+		alerts:        make(map[jcpc.JoyCon]*batteryAlert),
 
 		commandChan:      make(chan string, 1),
 		attemptPairingCh: make(chan struct{}, 1),
@@ -62,11 +104,63 @@ func New(of jcpc.OutputFactory, bt jcpc.BluetoothManager, opts jcpc.Options) *Ma
 	return m
 }
 
+// AddWatcher registers a Watcher to receive input from paired controllers.
+func (m *Manager) AddWatcher(w jcpc.Watcher) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.watchers = append(m.watchers, w)
+}
+
+// DisableConsole keeps Run from reading commands from stdin, even if it is
+// a terminal.
+func (m *Manager) DisableConsole() {
+	m.noConsole = true
+}
+
+// Stop disconnects all JoyCons and makes Run return.  It may be called more
+// than once.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.consoleExit)
+	})
+}
+
+// SetOptions replaces the options, e.g. after the config file changed.
+// Paired controllers get the new press, turbo, toggle and macro settings;
+// the other options only apply to controllers paired from now on.
+func (m *Manager) SetOptions(opts jcpc.Options) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.options = opts
+	m.hooks = newHooks(opts.Hooks)
+	m.alertConfigs = newAlertConfigs(opts)
+	tracked := m.trackedButtons()
+	for _, v := range m.paired {
+		v.c.TrackPresses(tracked)
+		var serials []string
+		for _, jc := range v.jc {
+			serials = append(serials, jc.Serial())
+		}
+		err := v.filter.Apply(m.options.ForController(serials...))
+		if err != nil {
+			log.With("serials", controllerKey(v.jc)).Warnf("bad controller options: %v", err)
+		}
+	}
+}
+
 func (m *Manager) Run() {
 	frameTicker := time.NewTicker(16666 * time.Microsecond)
 	btNotify := m.btManager.NotifyChannel()
 
-	go m.readStdin()
+	if m.noConsole {
+		log.Infof("running without a console, use jcctl to send commands")
+	} else if readline.IsTerminal(int(os.Stdin.Fd())) {
+		go m.readStdin()
+	} else {
+		log.Infof("stdin is not a terminal, use jcctl to send commands")
+	}
 	go m.btManager.InitialScan()
 
 	for {
@@ -79,7 +173,7 @@ func (m *Manager) Run() {
 			m.attemptPairing()
 
 		case <-m.consoleExit:
-			fmt.Println("Disconnecting controllers...")
+			log.Infof("disconnecting controllers...")
 			for _, cv := range m.paired {
 				cv.c.Close()
 				cv.o.Close()
@@ -109,17 +203,43 @@ func (m *Manager) OnFrame() {
 			jc.OnFrame()
 		}
 	}
-	for _, up := range m.unpaired {
+	now := time.Now()
+	for i := range m.unpaired {
+		up := &m.unpaired[i]
 		up.jc.OnFrame()
+		if !up.waitUntil.IsZero() && now.After(up.waitUntil) {
+			up.waitUntil = time.Time{}
+			log.With("serial", up.jc.Serial()).Infof("partner did not connect, pair u%d by hand", i+1)
+		}
 	}
+	m.stepBatteryAlerts(now)
 }
 
+// assignPlayerNumber picks the player number for new controller: the one
+// remembered for its JoyCons if it is free, otherwise the lowest free one
+// that no other controller prefers.
+//
 // must be called locked
-func (m *Manager) assignPlayerNumber() int {
-	var used [maxControllerCount]bool
+func (m *Manager) assignPlayerNumber(jcs []jcpc.JoyCon) int {
+	var used, reserved [maxControllerCount]bool
 
 	for _, v := range m.paired {
-		used[v.pNum-1] = true
+		if v.pNum >= 1 && v.pNum <= maxControllerCount {
+			used[v.pNum-1] = true
+		}
+	}
+	if pNum, ok := m.state.Slots[controllerKey(jcs)]; ok && pNum >= 1 && pNum <= maxControllerCount && !used[pNum-1] {
+		return pNum
+	}
+	for _, pNum := range m.state.Slots {
+		if pNum >= 1 && pNum <= maxControllerCount {
+			reserved[pNum-1] = true
+		}
+	}
+	for i := 0; i < maxControllerCount; i++ {
+		if !used[i] && !reserved[i] {
+			return i + 1
+		}
 	}
 	for i := 0; i < maxControllerCount; i++ {
 		if !used[i] {
@@ -140,108 +260,427 @@ var (
 	buttonsAnyLR = jcpc.ButtonState{}.Union(buttonsRZR).Union(buttonsLZL).Union(buttonsSLSR_L).Union(buttonsSLSR_R)
 )
 
-func (m *Manager) doPairing(idx1, idx2 int) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// pair_ pairs one unpaired JoyCon or Pro Controller, or a left and right
+// JoyCon (idx2 != -1), and removes them from the unpaired list.
+//
+// must be called locked
+func (m *Manager) pair_(idx1, idx2 int) error {
+	if idx2 != -1 {
+		t1, t2 := m.unpaired[idx1].jc.Type(), m.unpaired[idx2].jc.Type()
+		if idx1 == idx2 || t1.IsBoth() || t2.IsBoth() || t1.IsLeft() == t2.IsLeft() {
+			return errors.New("can only pair a left and a right Joy-Con")
+		}
+	}
+	if len(m.paired) >= maxControllerCount {
+		return errors.Errorf("all %d players are in use", maxControllerCount)
+	}
 
 	m.doPairing_(idx1, idx2)
 
-	didPair := []int{idx1, idx2}
-	if idx2 == -1 {
-		didPair = []int{idx1}
+	if idx2 != -1 {
+		if idx2 < idx1 {
+			idx1, idx2 = idx2, idx1
+		}
+		m.removeFromUnpaired_Locked(idx2)
+	}
+	m.removeFromUnpaired_Locked(idx1)
+	m.fixPlayerLights()
+	return nil
+}
+
+// pairNames_ pairs one or two unpaired JoyCons given by name, e.g. u1, and
+// returns the index of the new controller in m.paired.
+//
+// must be called locked
+func (m *Manager) pairNames_(names []string) (int, error) {
+	var idx []int
+	for _, name := range names {
+		i, err := m.selectUnpaired(name)
+		if err != nil {
+			return -1, err
+		}
+		idx = append(idx, i)
+	}
+	var err error
+	switch len(idx) {
+	case 1:
+		err = m.pair_(idx[0], -1)
+	case 2:
+		err = m.pair_(idx[0], idx[1])
+	default:
+		err = errors.New("specify one or two unpaired JoyCons")
+	}
+	if err != nil {
+		return -1, err
+	}
+	return len(m.paired) - 1, nil
+}
+
+// pairedIndex returns the index of a controller in m.paired, or -1.
+//
+// must be called locked
+func (m *Manager) pairedIndex(c jcpc.Controller) int {
+	for i, v := range m.paired {
+		if v.c == c {
+			return i
+		}
 	}
-	newUnpaired := make([]unpairedController, len(m.unpaired)-len(didPair))
-	sort.Ints(didPair)
-	i := 0
-	k := 0
-	for j, v := range m.unpaired {
-		if j == didPair[k] {
-			k++
-		} else {
-			newUnpaired[i] = v
-			i++
+	return -1
+}
+
+// split_ turns a pair of JoyCons into two single controllers.
+//
+// must be called locked
+func (m *Manager) split_(c jcpc.Controller) error {
+	var jcs []jcpc.JoyCon
+	for _, v := range m.paired {
+		if v.c == c {
+			jcs = v.jc
 		}
 	}
+	if jcs == nil {
+		return errors.New("controller was removed")
+	}
+	if len(jcs) != 2 {
+		return errors.New("only a pair of Joy-Cons can be split")
+	}
+	if len(m.paired) >= maxControllerCount {
+		return errors.Errorf("all %d players are in use", maxControllerCount)
+	}
+
+	err := m.unpair_(c)
+	if err != nil {
+		return err
+	}
+	// unpair_ appended the left and right JoyCon
+	err = m.pair_(len(m.unpaired)-2, -1)
+	if err != nil {
+		return err
+	}
+	return m.pair_(len(m.unpaired)-1, -1)
 }
 
 func (m *Manager) doPairing_(idx1, idx2 int) {
-	pNum := m.assignPlayerNumber()
+	jcs := []jcpc.JoyCon{m.unpaired[idx1].jc}
+	if idx2 != -1 {
+		jcs = append(jcs, m.unpaired[idx2].jc)
+	}
+	pNum := m.assignPlayerNumber(jcs)
 
-	if idx2 == -1 && m.unpaired[idx1].jc.Type() != jcpc.TypeBoth {
-		fmt.Println("pairing single")
+	if idx2 == -1 && !m.unpaired[idx1].jc.Type().IsBoth() {
+		log.Debugf("pairing single")
 		jc := m.unpaired[idx1].jc
-		o, err := m.outputFactory(jc.Type(), pNum, m.options.InputRemapping)
+		o, f, err := m.newOutput(jc.Type(), pNum, jc)
 		if err != nil {
-			fmt.Println("[FATAL] Failed to create controller output:", err)
+			log.Errorf("failed to create controller output: %v", err)
 			os.Exit(1)
 		}
 		c := controller.OneJoyCon(jc, m)
+		c.TrackPresses(m.trackedButtons())
+		name := m.options.ForController(jc.Serial()).Orientation
+		if g := m.findGroup(jc.Serial()); g != -1 && m.state.Groups[g].Orientation != "" {
+			name = m.state.Groups[g].Orientation
+		}
+		if name != "" {
+			if orient, ok := jcpc.ParseOrientation(name); ok {
+				c.(jcpc.OrientableController).SetOrientation(orient)
+			} else {
+				log.With("serial", jc.Serial()).Warnf("unknown orientation in controller options: %s", name)
+			}
+		}
 		c.BindToOutput(o)
 		jc.BindToController(c)
 		m.paired = append(m.paired, outputController{
-			c:    c,
-			o:    o,
-			jc:   []jcpc.JoyCon{jc},
-			pNum: pNum,
+			c:      c,
+			o:      o,
+			filter: f,
+			jc:     []jcpc.JoyCon{jc},
+			pNum:   pNum,
 		})
 	} else if idx2 == -1 {
-		fmt.Println("pairing pro")
+		log.Debugf("pairing pro")
 		jc := m.unpaired[idx1].jc
-		o, err := m.outputFactory(jcpc.TypeBoth, pNum, m.options.InputRemapping)
+		o, f, err := m.newOutput(jc.Type(), pNum, jc)
 		if err != nil {
-			fmt.Println("[FATAL] Failed to create controller output:", err)
+			log.Errorf("failed to create controller output: %v", err)
 			os.Exit(1)
 		}
 		c := controller.Pro(jc, m)
+		c.TrackPresses(m.trackedButtons())
 		c.BindToOutput(o)
 		jc.BindToController(c)
 		m.paired = append(m.paired, outputController{
-			c:    c,
-			o:    o,
-			jc:   []jcpc.JoyCon{jc},
-			pNum: pNum,
+			c:      c,
+			o:      o,
+			filter: f,
+			jc:     []jcpc.JoyCon{jc},
+			pNum:   pNum,
 		})
 	} else {
-		fmt.Println("pairing double")
+		log.Debugf("pairing double")
 		jc1 := m.unpaired[idx1].jc
 		jc2 := m.unpaired[idx2].jc
-		o, err := m.outputFactory(jcpc.TypeBoth, pNum, m.options.InputRemapping)
+		if !jc1.Type().IsLeft() {
+			jc1, jc2 = jc2, jc1
+		}
+		o, f, err := m.newOutput(jcpc.TypeBoth, pNum, jc1, jc2)
 		if err != nil {
-			fmt.Println("[FATAL] Failed to create controller output:", err)
+			log.Errorf("failed to create controller output: %v", err)
 			os.Exit(1)
 		}
-		var c jcpc.Controller
-		if jc1.Type().IsLeft() {
-			c = controller.TwoJoyCons(jc1, jc2, m)
-		} else {
-			c = controller.TwoJoyCons(jc2, jc1, m)
-		}
+		c := controller.TwoJoyCons(jc1, jc2, m)
+		c.TrackPresses(m.trackedButtons())
 		c.BindToOutput(o)
 		jc1.BindToController(c)
 		jc2.BindToController(c)
 		m.paired = append(m.paired, outputController{
-			c:    c,
-			o:    o,
-			jc:   []jcpc.JoyCon{jc1, jc2},
-			pNum: pNum,
+			c:      c,
+			o:      o,
+			filter: f,
+			jc:     []jcpc.JoyCon{jc1, jc2},
+			pNum:   pNum,
 		})
 	}
+	v := m.paired[len(m.paired)-1]
+	orientation := ""
+	if oc, ok := v.c.(jcpc.OrientableController); ok {
+		orientation = oc.Orientation().String()
+	}
+	m.rememberGroup(v.jc, orientation)
+	m.watchController(v)
+	info := m.controllerInfo(len(m.paired) - 1)
+	m.publish(control.Event{Type: control.EventPaired, Controller: &info})
 	m.fixPlayerLights()
 }
 
-var playerLightSeq = []byte{0xF0, 0x01, 0x03, 0x07, 0x0F, 0x05, 0x09, 0x06, 0x0A}
+// newOutput creates the output for a new controller, wrapped in a Filter
+// configured from the controller's options.
+//
+// must be called locked
+func (m *Manager) newOutput(t jcpc.JoyConType, pNum int, jcs ...jcpc.JoyCon) (jcpc.Output, *output.Filter, error) {
+	o, co, err := m.newDevice(t, pNum, jcs)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := output.NewFilter(o)
+	err = f.Apply(co)
+	if err != nil {
+		log.With("serials", controllerKey(jcs)).Warnf("bad controller options: %v", err)
+	}
+	f.BindLights(hostLights{m: m, o: f})
+	return f, f, nil
+}
+
+// newDevice creates the output for a controller with the factory.
+//
+// must be called locked
+func (m *Manager) newDevice(t jcpc.JoyConType, pNum int, jcs []jcpc.JoyCon) (jcpc.Output, jcpc.ControllerOptions, error) {
+	var serials []string
+	for _, jc := range jcs {
+		serials = append(serials, jc.Serial())
+	}
+	co := m.options.ForController(serials...)
+	remap := m.options.InputRemapping
+	if co.AnalogTriggers != nil {
+		remap.AnalogTriggers = *co.AnalogTriggers
+	}
+	if co.HatDPad != nil {
+		remap.HatDPad = *co.HatDPad
+	}
+	if co.ShiftLayers != nil {
+		remap.ShiftLayers = *co.ShiftLayers
+	}
+	o, err := m.outputFactory(t, pNum, serials, remap)
+	return o, co, err
+}
+
+// renumberDevice_ creates the output device of a controller for a new
+// player number, as the device name contains the number.  Pass it to
+// renumber_ to use it.
+//
+// must be called locked
+func (m *Manager) renumberDevice_(idx, pNum int) (jcpc.Output, error) {
+	v := &m.paired[idx]
+	t := v.jc[0].Type()
+	if len(v.jc) == 2 {
+		t = jcpc.TypeBoth
+	}
+	o, _, err := m.newDevice(t, pNum, v.jc)
+	return o, err
+}
+
+// renumber_ changes the player number of a controller to pNum, switching to
+// the output device from renumberDevice_.  The filter settings are kept.
+// The caller must update the watchers.
+//
+// must be called locked
+func (m *Manager) renumber_(idx, pNum int, o jcpc.Output) {
+	v := &m.paired[idx]
+	v.filter.SetOutput(o).Close()
+	delete(m.hostLights, v.o)
+	v.pNum = pNum
+	v.c.BindToOutput(v.o)
+	v.filter.BindLights(hostLights{m: m, o: v.o})
+}
+
+// setPlayer_ gives a controller a new player number and remembers it.  A
+// controller that already has the number gets the old one.
+//
+// must be called locked
+func (m *Manager) setPlayer_(idx, pNum int) error {
+	if pNum < 1 || pNum > maxControllerCount {
+		return errors.Errorf("player number must be from 1 to %d", maxControllerCount)
+	}
+	if m.paired[idx].pNum == pNum {
+		m.setPreferredSlot(m.paired[idx].jc, pNum)
+		return nil
+	}
+	other := -1
+	for i, v := range m.paired {
+		if v.pNum == pNum && i != idx {
+			other = i
+		}
+	}
+	oldNum := m.paired[idx].pNum
+
+	changed := []int{idx}
+	if other != -1 {
+		changed = append(changed, other)
+	}
+	for _, i := range changed {
+		for _, w := range m.watchers {
+			w.WatchController(m.paired[i].pNum, nil)
+		}
+	}
+	// Create both devices before switching either, so that a failure
+	// cannot leave two controllers with the same number.
+	o, err := m.renumberDevice_(idx, pNum)
+	var otherOut jcpc.Output
+	if err == nil && other != -1 {
+		otherOut, err = m.renumberDevice_(other, oldNum)
+		if err != nil {
+			o.Close()
+		}
+	}
+	if err == nil {
+		m.renumber_(idx, pNum, o)
+		m.setPreferredSlot(m.paired[idx].jc, pNum)
+		if other != -1 {
+			m.renumber_(other, oldNum, otherOut)
+			m.setPreferredSlot(m.paired[other].jc, oldNum)
+		}
+	}
+	for _, i := range changed {
+		m.watchController(m.paired[i])
+	}
+	m.fixPlayerLights()
+	return err
+}
+
+// hostLights receives the player lights that the host sets on an output.
+type hostLights struct {
+	m *Manager
+	o jcpc.Output
+}
+
+// Called from OnFrame, which is locked
+func (h hostLights) SetLights(pattern byte) {
+	if pattern == 0 {
+		delete(h.m.hostLights, h.o)
+	} else {
+		h.m.hostLights[h.o] = pattern
+	}
+	h.m.fixPlayerLights()
+}
+
+// SetHostLights sets the player lights of a controller as if the host set
+// them on its output.  A pattern of 0 shows the player number again.
+func (m *Manager) SetHostLights(pNum int, pattern byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.paired {
+		if c.pNum == pNum {
+			hostLights{m: m, o: c.o}.SetLights(pattern)
+			return nil
+		}
+	}
+	return errors.Errorf("no controller for player %d", pNum)
+}
+
+var defaultTrackedButtons = []jcpc.ButtonID{jcpc.Button_Home, jcpc.Button_Capture}
+
+// trackedButtons returns the buttons that generate short / long / double
+// press virtual buttons.
+func (m *Manager) trackedButtons() []jcpc.ButtonID {
+	if m.options.Presses.Buttons == nil {
+		return defaultTrackedButtons
+	}
+	var result []jcpc.ButtonID
+	for _, name := range m.options.Presses.Buttons {
+		b, ok := jcpc.ParseButton(name)
+		if !ok {
+			log.Warnf("unknown button in press options: %s", name)
+			continue
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+// PressAction runs the console command configured for a virtual button.
+func (m *Manager) PressAction(c jcpc.Controller, b jcpc.ButtonID) {
+	var cmds []string
+	m.mu.Lock()
+	for name, cmd := range m.options.Presses.Actions {
+		if action, ok := jcpc.ParseButton(name); ok && action == b {
+			cmds = append(cmds, cmd)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, cmd := range cmds {
+		log.Infof("%s pressed, running '%s'", b, cmd)
+		m.handleCommand(strings.Fields(cmd))
+	}
+}
+
+// The player lights the Switch uses for players 1 to 8.  Shifted into the
+// upper nibble, the same lights flash.
+var playerLightSeq = []byte{0x01, 0x03, 0x07, 0x0F, 0x09, 0x05, 0x0D, 0x06}
+
+// playerLights returns the light pattern of a player number, or all lights
+// flashing if there is none.
+func playerLights(pNum int, flash bool) byte {
+	if pNum < 1 || pNum > len(playerLightSeq) {
+		return 0xF0
+	}
+	if flash {
+		return playerLightSeq[pNum-1] << 4
+	}
+	return playerLightSeq[pNum-1]
+}
 
 func (m *Manager) fixPlayerLights() {
 	// TODO separate business logic and moving arrays around
 	// Fix player lights
 	for _, c := range m.paired {
+		pattern := playerLights(c.pNum, false)
+		if p, ok := m.hostLights[c.o]; ok {
+			pattern = p
+		}
 		for _, jc := range c.jc {
-			jcpc.SetPlayerLights(jc, playerLightSeq[c.pNum])
+			if m.isBlinking(jc) {
+				// flash the lit lights too
+				jcpc.SetPlayerLights(jc, pattern<<4|pattern&0xF0)
+			} else {
+				jcpc.SetPlayerLights(jc, pattern)
+			}
 		}
 	}
 
 	for i, up := range m.unpaired {
-		jcpc.SetPlayerLights(up.jc, byte((i+1)<<4))
+		jcpc.SetPlayerLights(up.jc, playerLights(i+1, true))
 	}
 }
 
@@ -255,6 +694,10 @@ func (m *Manager) attemptPairing() {
 	var didPair []int
 
 	for idx, up := range m.unpaired {
+		if len(m.paired) >= maxControllerCount {
+			log.Infof("all %d players are in use", maxControllerCount)
+			break
+		}
 		if up.curButtons.HasAll(buttonsSLSR_L) || up.curButtons.HasAll(buttonsSLSR_R) {
 			m.doPairing_(idx, -1)
 			didPair = append(didPair, idx)
@@ -290,10 +733,33 @@ func (m *Manager) attemptPairing() {
 	}
 }
 
+// must be called locked
+func (m *Manager) watchController(c outputController) {
+	for _, w := range m.watchers {
+		w.WatchController(c.pNum, c.jc)
+	}
+}
+
 func (m *Manager) JoyConUpdate(jc jcpc.JoyCon, flags int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.dashboard != nil && flags&jcpc.NotifyInput != 0 {
+		m.dashboard.countReport(jc)
+	}
+	if len(m.watchers) > 0 {
+		for _, c := range m.paired {
+			for _, cjc := range c.jc {
+				if cjc != jc {
+					continue
+				}
+				for _, w := range m.watchers {
+					w.WatchUpdate(c.pNum, jc, flags)
+				}
+			}
+		}
+	}
+
 	if flags&jcpc.NotifyConnection != 0 {
 		idx := -1
 		for i, aJC := range m.wantReconnect {
@@ -305,12 +771,21 @@ func (m *Manager) JoyConUpdate(jc jcpc.JoyCon, flags int) {
 		if !jc.WantsReconnect() != (idx == -1) {
 			if idx == -1 {
 				m.wantReconnect = append(m.wantReconnect, jc)
-				fmt.Printf("JoyCon %s needs reconnecting\n", jc.Serial())
+				log.With("serial", jc.Serial()).Infof("JoyCon needs reconnecting")
 			} else {
 				m.wantReconnect = append(m.wantReconnect[:idx], m.wantReconnect[idx+1:]...)
 			}
 		}
 
+		if jc.IsStopping() {
+			delete(m.lowBattery, jc)
+			delete(m.alerts, jc)
+			if name := m.joyConName(jc); name != "" {
+				info := joyConInfo(name, jc)
+				m.publish(control.Event{Type: control.EventDisconnected, JoyCon: &info})
+			}
+		}
+
 		idx = -1
 		for i, v := range m.unpaired {
 			if jc == v.jc {
@@ -320,7 +795,7 @@ func (m *Manager) JoyConUpdate(jc jcpc.JoyCon, flags int) {
 		}
 		if idx != -1 {
 			if jc.IsStopping() {
-				fmt.Println("removing", jc.Serial())
+				log.With("serial", jc.Serial()).Infof("removing")
 				m.removeFromUnpaired_Locked(idx)
 				return
 			}
@@ -347,28 +822,80 @@ func (m *Manager) JoyConUpdate(jc jcpc.JoyCon, flags int) {
 				}
 			}
 			if up.curButtons.HasAny(diff) {
-				fmt.Printf("Plonk! (u%d)\n", idx)
+				log.With("serial", jc.Serial()).Infof("Plonk! (u%d)", idx+1)
 				// make a sound on the ui?
 			}
-		} else {
+		} else if len(m.hooks) > 0 {
+			m.checkChords(jc)
 		}
 	}
 
 	if flags&jcpc.NotifyBattery != 0 {
-		fmt.Printf("%s (%s): %s\n", jc.Type().String(), jc.Serial(), renderBattery(jc.Battery()))
+		log.With("serial", jc.Serial()).Infof("%s battery: %s", jc.Type().String(), renderBattery(jc.Battery()))
+		if name := m.joyConName(jc); name != "" {
+			info := joyConInfo(name, jc)
+			m.publish(control.Event{Type: control.EventBattery, JoyCon: &info})
+		}
+		m.checkLowBattery(jc)
+		m.updateBatteryAlert(jc)
+	}
+}
+
+// checkLowBattery runs the low-battery hooks when a JoyCon's battery runs
+// low, once until it is charged.
+//
+// must be called locked
+func (m *Manager) checkLowBattery(jc jcpc.JoyCon) {
+	level, charging := jc.Battery()
+	low := level <= lowBatteryLevel && !charging
+	if low == m.lowBattery[jc] {
+		return
+	}
+	if !low {
+		delete(m.lowBattery, jc)
+		return
+	}
+	m.lowBattery[jc] = true
+	log.With("serial", jc.Serial()).Warnf("%s battery is low", jc.Type())
+	if name := m.joyConName(jc); name != "" {
+		vars := joyConVars(joyConInfo(name, jc))
+		vars["event"] = hookLowBattery
+		m.runHooks(hookLowBattery, vars)
+	}
+}
+
+// checkChords runs the chord hooks for the controller of a paired JoyCon.
+//
+// must be called locked
+func (m *Manager) checkChords(jc jcpc.JoyCon) {
+	for i, c := range m.paired {
+		for _, cjc := range c.jc {
+			if cjc != jc {
+				continue
+			}
+			var cur jcpc.ButtonState
+			for _, j := range c.jc {
+				cur = cur.Union(j.Buttons())
+			}
+			prev := m.chordButtons[c.c]
+			m.chordButtons[c.c] = cur
+			m.runChordHooks(i, prev, cur)
+			return
+		}
 	}
 }
 
 func (m *Manager) SearchDevices() error {
 	deviceList, err := hid.Enumerate(jcpc.VENDOR_NINTENDO, 0)
 	if err != nil {
-		fmt.Println("Enumeration error:", err)
+		log.Errorf("enumeration error: %v", err)
 		return err
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	var added []jcpc.JoyCon
 outer:
 	for i, dev := range deviceList {
 		// Check for reconnects
@@ -396,9 +923,9 @@ outer:
 		handle, err := dev.Device()
 		if err != nil {
 			if os.IsPermission(err) {
-				fmt.Println("Couldn't open JoyCon device - install udev rules or run as sudo")
+				log.Errorf("couldn't open JoyCon device - install udev rules or run as sudo")
 			} else {
-				fmt.Println("Couldn't open JoyCon device:", err)
+				log.With("serial", dev.SerialNumber).Errorf("couldn't open JoyCon device: %v", err)
 			}
 			return err
 		}
@@ -409,7 +936,7 @@ outer:
 		case jcpc.JOYCON_PRODUCT_R:
 			jc, err = joycon.NewBluetooth(handle, jcpc.TypeRight, m)
 		case jcpc.JOYCON_PRODUCT_PRO:
-			jc, err = joycon.NewBluetooth(handle, jcpc.TypeBoth, m)
+			jc, err = joycon.NewBluetooth(handle, jcpc.TypePro, m)
 		case jcpc.JOYCON_PRODUCT_CHARGEGRIP:
 			if dev.InterfaceNumber == 1 {
 				handle.Close()
@@ -423,7 +950,7 @@ outer:
 				}
 			}
 			if err != nil {
-				fmt.Println("Couldn't open JoyCon device:", err)
+				log.With("serial", dev.SerialNumber).Errorf("couldn't open JoyCon device: %v", err)
 				handle.Close()
 				return err
 			}
@@ -440,21 +967,115 @@ outer:
 		}
 		if err != nil {
 			handle.Close()
-			fmt.Println("Couldn't initialize JoyCon:", err)
+			log.With("serial", dev.SerialNumber).Errorf("couldn't initialize JoyCon: %v", err)
 			continue outer
 		}
 
 		m.unpaired = append(m.unpaired, unpairedController{jc: jc})
-		fmt.Println("[INFO] Connected to", jc.Type(), jc.Serial())
+		log.With("serial", jc.Serial()).Infof("connected to %s", jc.Type())
+		info := joyConInfo(fmt.Sprintf("u%d", len(m.unpaired)), jc)
+		m.publish(control.Event{Type: control.EventConnected, JoyCon: &info})
+		added = append(added, jc)
 	} // range deviceList
+	for _, jc := range added {
+		m.autoPair_(jc)
+	}
 	m.fixPlayerLights()
 	return nil
 }
 
+// autoPair_ pairs a newly connected JoyCon the way it was paired before.
+// A JoyCon of a pair waits groupWaitTimeout for the other one.
+//
+// must be called locked
+func (m *Manager) autoPair_(jc jcpc.JoyCon) {
+	g := m.findGroup(jc.Serial())
+	if g == -1 {
+		return
+	}
+	idx := m.unpairedIndex(jc)
+	if idx == -1 {
+		return
+	}
+	lg := log.With("serial", jc.Serial())
+	serials := m.state.Groups[g].Serials
+	if len(serials) == 1 {
+		if err := m.pair_(idx, -1); err != nil {
+			lg.Warnf("could not pair again: %v", err)
+			return
+		}
+		lg.Infof("paired again as c%d", len(m.paired))
+		return
+	}
+
+	partner := serials[0]
+	if partner == jc.Serial() {
+		partner = serials[1]
+	}
+	pIdx := -1
+	for i, up := range m.unpaired {
+		if up.jc.Serial() == partner && !up.waitUntil.IsZero() {
+			pIdx = i
+		}
+	}
+	if pIdx == -1 {
+		m.unpaired[idx].waitUntil = time.Now().Add(groupWaitTimeout)
+		lg.Infof("waiting %v for the other Joy-Con (%s)", groupWaitTimeout, partner)
+		return
+	}
+	if err := m.pair_(idx, pIdx); err != nil {
+		lg.Warnf("could not pair again: %v", err)
+		return
+	}
+	lg.Infof("paired again with %s as c%d", partner, len(m.paired))
+}
+
+// unpairedIndex returns the index of a JoyCon in m.unpaired, or -1.
+//
+// must be called locked
+func (m *Manager) unpairedIndex(jc jcpc.JoyCon) int {
+	for i, up := range m.unpaired {
+		if up.jc == jc {
+			return i
+		}
+	}
+	return -1
+}
+
 func (m *Manager) RemoveController(c jcpc.Controller) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	v, ok := m.removePaired_(c)
+	if !ok {
+		return
+	}
+	for _, jc := range v.jc {
+		jc.Close()
+	}
+}
+
+// unpair_ removes a controller and puts its JoyCons back in the unpaired
+// list, still connected.  The controller is not paired again automatically.
+//
+// must be called locked
+func (m *Manager) unpair_(c jcpc.Controller) error {
+	v, ok := m.removePaired_(c)
+	if !ok {
+		return errors.New("controller was removed")
+	}
+	for _, jc := range v.jc {
+		m.forgetGroup(jc.Serial())
+		m.unpaired = append(m.unpaired, unpairedController{jc: jc})
+	}
+	m.fixPlayerLights()
+	return nil
+}
+
+// removePaired_ closes a controller and its output and unbinds its JoyCons.
+//
+// must be called locked
+func (m *Manager) removePaired_(c jcpc.Controller) (outputController, bool) {
 	idx := -1
 	for i, v := range m.paired {
 		if v.c == c {
@@ -463,13 +1084,21 @@ func (m *Manager) RemoveController(c jcpc.Controller) {
 		}
 	}
 	if idx == -1 {
-		return
+		return outputController{}, false
 	}
+	info := m.controllerInfo(idx)
 	v := m.paired[idx]
 	m.paired = append(m.paired[:idx], m.paired[idx+1:]...)
-	v.c.Close()
-	v.o.Close()
+	delete(m.hostLights, v.o)
+	delete(m.chordButtons, v.c)
+	for _, w := range m.watchers {
+		w.WatchController(v.pNum, nil)
+	}
 	for _, jc := range v.jc {
-		jc.Close()
+		jc.BindToController(nil)
 	}
+	v.c.Close()
+	v.o.Close()
+	m.publish(control.Event{Type: control.EventUnpaired, Controller: &info})
+	return v, true
 }
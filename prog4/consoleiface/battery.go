@@ -0,0 +1,149 @@
+package consoleiface
+
+import (
+	"time"
+
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// How long the player lights blink for each alert
+const alertBlinkTime = 3 * time.Second
+
+var (
+	defaultLowBattery = jcpc.BatteryAlertOptions{
+		Alerts:   []string{"rumble", "lights"},
+		Interval: "5m",
+	}
+	defaultCriticalBattery = jcpc.BatteryAlertOptions{
+		Alerts:   []string{"rumble", "lights", "home"},
+		Interval: "1m",
+	}
+
+	// two short buzzes
+	alertRumble = []jcpc.RumbleData{
+		jcpc.RumbleFromMagnitude(40000, 20000, 9),
+		{Data: jcpc.RumbleDataNeutral.Data, Time: 6},
+		jcpc.RumbleFromMagnitude(40000, 20000, 9),
+		jcpc.RumbleDataNeutral,
+	}
+	// 2 mini cycles, fading between full and off, 3 times
+	alertHomePulse = []byte{0x2F, 0x03, 0xF0, 0x22, 0x22}
+)
+
+type alertConfig struct {
+	rumble, lights, home bool
+	interval             time.Duration
+}
+
+// newAlertConfig checks the options of a battery alert.  Invalid entries
+// are replaced by the defaults with a warning.
+func newAlertConfig(o, def jcpc.BatteryAlertOptions) alertConfig {
+	if o.Alerts == nil {
+		o.Alerts = def.Alerts
+	}
+	if o.Interval == "" {
+		o.Interval = def.Interval
+	}
+
+	var cfg alertConfig
+	for _, name := range o.Alerts {
+		switch name {
+		case "rumble":
+			cfg.rumble = true
+		case "lights":
+			cfg.lights = true
+		case "home":
+			cfg.home = true
+		default:
+			log.Warnf("unknown battery alert: %s", name)
+		}
+	}
+	d, err := time.ParseDuration(o.Interval)
+	if err != nil || d <= 0 {
+		log.Warnf("invalid battery alert interval: %s", o.Interval)
+		d, _ = time.ParseDuration(def.Interval)
+	}
+	cfg.interval = d
+	return cfg
+}
+
+// newAlertConfigs returns the alert configuration by battery level.
+func newAlertConfigs(opts jcpc.Options) [lowBatteryLevel + 1]alertConfig {
+	return [...]alertConfig{
+		newAlertConfig(opts.CriticalBattery, defaultCriticalBattery),
+		newAlertConfig(opts.LowBattery, defaultLowBattery),
+	}
+}
+
+// batteryAlert is the alert state of a JoyCon with a low battery.
+type batteryAlert struct {
+	level int8
+	next  time.Time
+	// set while the player lights blink
+	blinkUntil time.Time
+}
+
+// updateBatteryAlert starts, escalates or stops the alert of a JoyCon after
+// its battery changed.
+//
+// must be called locked
+func (m *Manager) updateBatteryAlert(jc jcpc.JoyCon) {
+	level, charging := jc.Battery()
+	a := m.alerts[jc]
+	if charging || level > lowBatteryLevel {
+		if a != nil {
+			delete(m.alerts, jc)
+			if !a.blinkUntil.IsZero() {
+				m.fixPlayerLights()
+			}
+		}
+		return
+	}
+	if a == nil {
+		m.alerts[jc] = &batteryAlert{level: level}
+	} else if level < a.level {
+		// alert right away
+		a.level = level
+		a.next = time.Time{}
+	}
+}
+
+// stepBatteryAlerts repeats the alerts that are due.
+//
+// must be called locked
+func (m *Manager) stepBatteryAlerts(now time.Time) {
+	fixLights := false
+	for jc, a := range m.alerts {
+		if !a.blinkUntil.IsZero() && now.After(a.blinkUntil) {
+			a.blinkUntil = time.Time{}
+			fixLights = true
+		}
+		if now.Before(a.next) {
+			continue
+		}
+		cfg := m.alertConfigs[a.level]
+		a.next = now.Add(cfg.interval)
+		if cfg.rumble {
+			jc.Rumble(alertRumble)
+		}
+		if cfg.home && jc.Type() != jcpc.TypeLeft {
+			jcpc.SetHomeLightPulse(jc, alertHomePulse)
+		}
+		if cfg.lights {
+			a.blinkUntil = now.Add(alertBlinkTime)
+			fixLights = true
+		}
+	}
+	if fixLights {
+		m.fixPlayerLights()
+	}
+}
+
+// isBlinking reports whether the player lights of a JoyCon show a battery
+// alert.
+//
+// must be called locked
+func (m *Manager) isBlinking(jc jcpc.JoyCon) bool {
+	a := m.alerts[jc]
+	return a != nil && !a.blinkUntil.IsZero()
+}
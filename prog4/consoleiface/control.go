@@ -0,0 +1,260 @@
+package consoleiface
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"time"
+
+	"github.com/riking/joycon/prog4/control"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// ServeControl implements the methods of the control socket and sends it
+// events.
+func (m *Manager) ServeControl(s *control.Server) {
+	m.mu.Lock()
+	m.control = s
+	m.mu.Unlock()
+
+	s.Handle(control.MethodList, m.ctlList)
+	s.Handle(control.MethodPair, m.ctlPair)
+	s.Handle(control.MethodUnpair, m.ctlUnpair)
+	s.Handle(control.MethodLights, m.ctlLights)
+	s.Handle(control.MethodRumble, m.ctlRumble)
+	s.Handle(control.MethodStartSync, m.ctlStartSync)
+	s.Handle(control.MethodStopSync, m.ctlStopSync)
+	s.Handle(control.MethodSPIRead, m.ctlSPIRead)
+	s.Handle(control.MethodSPIWrite, m.ctlSPIWrite)
+	s.Handle(control.MethodCommand, m.ctlCommand)
+}
+
+// publish sends an event to the control socket and runs the script and
+// hooks configured for it.
+//
+// must be called locked
+func (m *Manager) publish(ev control.Event) {
+	if m.control != nil {
+		m.control.Publish(ev)
+	}
+	m.runEventScript(ev)
+	m.runHooks(ev.Type, eventVars(ev))
+}
+
+func joyConInfo(name string, jc jcpc.JoyCon) control.JoyConInfo {
+	level, charging := jc.Battery()
+	return control.JoyConInfo{
+		Name:        name,
+		Type:        jc.Type().String(),
+		Serial:      jc.Serial(),
+		Battery:     level,
+		Charging:    charging,
+		CaseColor:   colorString(jc.CaseColor()),
+		ButtonColor: colorString(jc.ButtonColor()),
+	}
+}
+
+func colorString(c color.RGBA) string {
+	if c.A == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+// must be called locked
+func (m *Manager) controllerInfo(idx int) control.ControllerInfo {
+	c := m.paired[idx]
+	info := control.ControllerInfo{
+		Name:   fmt.Sprintf("c%d", idx+1),
+		Player: c.pNum,
+	}
+	if len(c.jc) == 2 {
+		info.Type = "Joy-Con pair"
+		info.JoyCons = []control.JoyConInfo{
+			joyConInfo(info.Name+"l", c.jc[0]),
+			joyConInfo(info.Name+"r", c.jc[1]),
+		}
+	} else {
+		info.Type = c.jc[0].Type().String()
+		info.JoyCons = []control.JoyConInfo{joyConInfo(info.Name, c.jc[0])}
+	}
+	return info
+}
+
+// must be called locked
+func (m *Manager) listInfo() control.ListResult {
+	result := control.ListResult{
+		Unpaired: []control.JoyConInfo{},
+		Paired:   []control.ControllerInfo{},
+	}
+	for i, up := range m.unpaired {
+		result.Unpaired = append(result.Unpaired, joyConInfo(fmt.Sprintf("u%d", i+1), up.jc))
+	}
+	for i := range m.paired {
+		result.Paired = append(result.Paired, m.controllerInfo(i))
+	}
+	return result
+}
+
+// must be called locked
+func (m *Manager) joyConName(jc jcpc.JoyCon) string {
+	for i, up := range m.unpaired {
+		if up.jc == jc {
+			return fmt.Sprintf("u%d", i+1)
+		}
+	}
+	for i, c := range m.paired {
+		for k, cjc := range c.jc {
+			if cjc != jc {
+				continue
+			}
+			if len(c.jc) == 1 {
+				return fmt.Sprintf("c%d", i+1)
+			}
+			return fmt.Sprintf("c%d%c", i+1, "lr"[k])
+		}
+	}
+	return ""
+}
+
+func (m *Manager) ctlList(params json.RawMessage) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listInfo(), nil
+}
+
+func (m *Manager) ctlPair(params json.RawMessage) (interface{}, error) {
+	var p control.PairParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, err := m.pairNames_(p.JoyCons)
+	if err != nil {
+		return nil, err
+	}
+	return m.controllerInfo(idx), nil
+}
+
+func (m *Manager) ctlUnpair(params json.RawMessage) (interface{}, error) {
+	var p control.ControllerParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	c, _, err := selectController(m, []string{p.Controller})
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = m.unpair_(c.c)
+	if err != nil {
+		return nil, err
+	}
+	return m.listInfo(), nil
+}
+
+func (m *Manager) ctlLights(params json.RawMessage) (interface{}, error) {
+	var p control.LightsParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	jc, _, err := selectJoyCon(m, []string{p.JoyCon})
+	if err != nil {
+		return nil, err
+	}
+	jcpc.SetPlayerLights(jc, p.Pattern)
+	return nil, nil
+}
+
+func (m *Manager) ctlRumble(params json.RawMessage) (interface{}, error) {
+	var p control.RumbleParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	jc, _, err := selectJoyCon(m, []string{p.JoyCon})
+	if err != nil {
+		return nil, err
+	}
+	rumble(jc, p.Strong, p.Weak, time.Duration(p.Duration)*time.Millisecond)
+	return nil, nil
+}
+
+func (m *Manager) ctlStartSync(params json.RawMessage) (interface{}, error) {
+	m.btManager.StartDiscovery()
+	return nil, nil
+}
+
+func (m *Manager) ctlStopSync(params json.RawMessage) (interface{}, error) {
+	m.btManager.StopDiscovery()
+	return nil, nil
+}
+
+func (m *Manager) ctlSPIRead(params json.RawMessage) (interface{}, error) {
+	var p control.SPIReadParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	err = jcpc.CheckSPIRange(p.Address, p.Size)
+	if err != nil {
+		return nil, &control.Error{Code: control.CodeInvalidParams, Message: err.Error()}
+	}
+	jc, _, err := selectJoyCon(m, []string{p.JoyCon})
+	if err != nil {
+		return nil, err
+	}
+	b, err := jcpc.SPIFlashRead(jc, p.Address, p.Size)
+	if err != nil {
+		return nil, err
+	}
+	return control.SPIReadResult{Data: b}, nil
+}
+
+func (m *Manager) ctlSPIWrite(params json.RawMessage) (interface{}, error) {
+	var p control.SPIWriteParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	err = jcpc.CheckSPIRange(p.Address, uint32(len(p.Data)))
+	if err != nil {
+		return nil, &control.Error{Code: control.CodeInvalidParams, Message: err.Error()}
+	}
+	jc, _, err := selectJoyCon(m, []string{p.JoyCon})
+	if err != nil {
+		return nil, err
+	}
+	return nil, jc.SPIWrite(p.Address, p.Data)
+}
+
+func (m *Manager) ctlCommand(params json.RawMessage) (interface{}, error) {
+	var p control.CommandParams
+	err := control.DecodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Args) == 0 {
+		return nil, &control.Error{Code: control.CodeInvalidParams, Message: "missing command"}
+	}
+	if p.Args[0] == "source" {
+		// The driver usually runs as root, and the errors of a script
+		// quote the file, so clients could read any file with it.
+		return nil, &control.Error{Code: control.CodeInvalidParams, Message: "source is only available at the console"}
+	}
+	var buf bytes.Buffer
+	err = m.RunCommand(&buf, p.Args)
+	if err != nil {
+		return nil, err
+	}
+	return control.CommandResult{Output: buf.String()}, nil
+}
@@ -0,0 +1,137 @@
+package consoleiface
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+const (
+	defaultHookTimeout = 30 * time.Second
+
+	// Events that only hooks receive
+	hookLowBattery = "low-battery"
+	hookChord      = "chord"
+
+	// Battery level at which low-battery hooks run
+	lowBatteryLevel = 1
+)
+
+// hook is a configured shell command, see jcpc.HookOptions.
+type hook struct {
+	opts    jcpc.HookOptions
+	timeout time.Duration
+	chord   jcpc.ButtonState
+	// holds a value for each running copy
+	running chan struct{}
+}
+
+// newHooks checks the hook options.  Invalid hooks are skipped with a
+// warning.
+func newHooks(opts []jcpc.HookOptions) []*hook {
+	var hooks []*hook
+	for _, o := range opts {
+		lg := log.With("hook", o.Command)
+		h := &hook{opts: o, timeout: defaultHookTimeout}
+		if o.Timeout != "" {
+			d, err := time.ParseDuration(o.Timeout)
+			if err != nil {
+				lg.Warnf("invalid timeout %s", o.Timeout)
+				continue
+			}
+			h.timeout = d
+		}
+		if o.MaxRunning > 0 {
+			h.running = make(chan struct{}, o.MaxRunning)
+		} else {
+			h.running = make(chan struct{}, 1)
+		}
+		if o.Event == hookChord {
+			ok := len(o.Buttons) > 0
+			for _, name := range o.Buttons {
+				b, valid := jcpc.ParseButton(name)
+				if !valid || b != b.Physical() {
+					lg.Warnf("unknown button in chord: %s", name)
+					ok = false
+					break
+				}
+				h.chord = h.chord.Set(b, true)
+			}
+			if !ok {
+				continue
+			}
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+// runHooks starts the hooks for an event.  vars are passed in the
+// environment as JC_<NAME>.
+//
+// must be called locked
+func (m *Manager) runHooks(event string, vars map[string]string) {
+	for _, h := range m.hooks {
+		if h.opts.Event == event && h.opts.Event != hookChord {
+			h.start(vars)
+		}
+	}
+}
+
+// runChordHooks starts the chord hooks that the buttons held on a
+// controller completed.
+//
+// must be called locked
+func (m *Manager) runChordHooks(idx int, prev, cur jcpc.ButtonState) {
+	var vars map[string]string
+	for _, h := range m.hooks {
+		if h.opts.Event != hookChord || !cur.HasAll(h.chord) || prev.HasAll(h.chord) {
+			continue
+		}
+		if vars == nil {
+			info := m.controllerInfo(idx)
+			vars = controllerVars(info)
+			vars["event"] = hookChord
+		}
+		vars["buttons"] = strings.Join(h.opts.Buttons, "+")
+		h.start(vars)
+	}
+}
+
+func (h *hook) start(vars map[string]string) {
+	lg := log.With("hook", h.opts.Command)
+	select {
+	case h.running <- struct{}{}:
+	default:
+		lg.Warnf("already running %d times, skipping %s", cap(h.running), vars["event"])
+		return
+	}
+
+	env := os.Environ()
+	for k, v := range vars {
+		env = append(env, "JC_"+strings.ToUpper(k)+"="+v)
+	}
+	go func() {
+		defer func() { <-h.running }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", h.opts.Command)
+		cmd.Env = env
+		// not a pipe, so that programs started in the background don't
+		// keep Wait from returning
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		lg.Debugf("running for %s", vars["event"])
+		err := cmd.Run()
+		if ctx.Err() == context.DeadlineExceeded {
+			lg.Warnf("killed after %v", h.timeout)
+		} else if err != nil {
+			lg.Warnf("failed: %v", err)
+		}
+	}()
+}
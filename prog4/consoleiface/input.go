@@ -4,13 +4,17 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chzyer/readline"
 	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
+	"github.com/riking/joycon/prog4/output"
 )
 
 func filterCtrlZ(r rune) (rune, bool) {
@@ -35,6 +39,9 @@ func (m *Manager) readStdin() {
 		panic(err)
 	}
 	defer l.Close()
+	// keep log messages from clobbering the prompt
+	jclog.SetConsole(l.Stdout())
+	defer jclog.SetConsole(os.Stdout)
 
 	for {
 		line, err := l.Readline()
@@ -50,7 +57,7 @@ func (m *Manager) readStdin() {
 
 		m.handleCommand(strings.Fields(line))
 	}
-	close(m.consoleExit)
+	m.Stop()
 }
 
 func findCommand(name string) commandMeta {
@@ -64,16 +71,24 @@ func findCommand(name string) commandMeta {
 	return commandMeta{}
 }
 
+// handleCommand runs a command typed at the console.
 func (m *Manager) handleCommand(argv []string) {
+	err := m.RunCommand(os.Stdout, argv)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// RunCommand runs a console command, writing its output to w.
+func (m *Manager) RunCommand(w io.Writer, argv []string) error {
 	if len(argv) == 0 {
-		return
+		return nil
 	}
 	meta := findCommand(argv[0])
 	if meta.F == nil {
-		fmt.Println("unknown command", argv[0])
-		return
+		return errors.Errorf("unknown command %s", argv[0])
 	}
-	meta.F(m, argv[1:])
+	return meta.F(m, w, argv[1:])
 }
 
 var rgxSelectUnpaired = regexp.MustCompile(`u([0-9]+)`)
@@ -123,6 +138,47 @@ func selectJoyCon(m *Manager, argv []string) (jc jcpc.JoyCon, newArgv []string,
 	}
 }
 
+// selectUnpaired finds an unpaired JoyCon by name, e.g. u1.
+//
+// must be called locked
+func (m *Manager) selectUnpaired(str string) (int, error) {
+	match := rgxSelectUnpaired.FindStringSubmatch(str)
+	if match == nil || match[0] != str {
+		return -1, errors.Errorf("Not an unpaired JoyCon: '%s'", str)
+	}
+	num, err := strconv.Atoi(match[1])
+	if err != nil {
+		return -1, errors.Wrap(err, fmt.Sprintf("Could not select JoyCon '%s'", str))
+	}
+	if num < 1 || num > len(m.unpaired) {
+		return -1, errors.Errorf("Unpaired JoyCon number %s out of range (have %d)", str, len(m.unpaired))
+	}
+	return num - 1, nil
+}
+
+var rgxSelectController = regexp.MustCompile(`^c([0-9]+)$`)
+
+func selectController(m *Manager, argv []string) (c outputController, newArgv []string, err error) {
+	if len(argv) == 0 {
+		return c, argv, errors.Errorf("No arguments")
+	}
+	str := argv[0]
+	match := rgxSelectController.FindStringSubmatch(str)
+	if match == nil {
+		return c, argv, errors.Errorf("Not a valid controller selector: '%s'", str)
+	}
+	num, err := strconv.Atoi(match[1])
+	if err != nil {
+		return c, argv, errors.Wrap(err, fmt.Sprintf("Could not select controller '%s'", str))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if num < 1 || num > len(m.paired) {
+		return c, argv, errors.Errorf("Controller number %s out of range (have %d)", str, len(m.paired))
+	}
+	return m.paired[num-1], argv[1:], nil
+}
+
 const colorBad = "\033[1m\033[41m\033[37m"
 const colorMid = "\033[1m\033[33m"
 const colorGood = "\033[1m\033[32m"
@@ -145,27 +201,27 @@ func renderBattery(level int8, charging bool) string {
 	}
 }
 
-func printConnectedJoyCons(m *Manager) {
+func printConnectedJoyCons(m *Manager, w io.Writer) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	fmt.Println("Connected JoyCons:")
+	fmt.Fprintln(w, "Connected JoyCons:")
 	for i, up := range m.unpaired {
-		fmt.Printf("  u%d: %s %s %s\n", i+1, up.jc.Type().String(), up.jc.Serial(), renderBattery(up.jc.Battery()))
+		fmt.Fprintf(w, "  u%d: %s %s %s\n", i+1, up.jc.Type().String(), up.jc.Serial(), renderBattery(up.jc.Battery()))
 	}
 	for i, c := range m.paired {
 		if len(c.jc) == 2 {
-			fmt.Printf("  c%dl: %s %s\n", i+1, c.jc[0].Serial(), renderBattery(c.jc[0].Battery()))
-			fmt.Printf("  c%dr: %s %s\n", i+1, c.jc[1].Serial(), renderBattery(c.jc[1].Battery()))
+			fmt.Fprintf(w, "  c%dl: %s %s\n", i+1, c.jc[0].Serial(), renderBattery(c.jc[0].Battery()))
+			fmt.Fprintf(w, "  c%dr: %s %s\n", i+1, c.jc[1].Serial(), renderBattery(c.jc[1].Battery()))
 		} else {
-			fmt.Printf("  c%d: %s %s %s\n", i+1, c.jc[0].Type().String(), c.jc[0].Serial(), renderBattery(c.jc[0].Battery()))
+			fmt.Fprintf(w, "  c%d: %s %s %s\n", i+1, c.jc[0].Type().String(), c.jc[0].Serial(), renderBattery(c.jc[0].Battery()))
 		}
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
 type commandMeta struct {
-	F       func(*Manager, []string)
+	F       func(m *Manager, w io.Writer, argv []string) error
 	Aliases []string
 	Help    string
 }
@@ -176,7 +232,7 @@ func (m *commandMeta) Name() string {
 
 var commands []commandMeta
 
-func addCommand(F func(*Manager, []string), help string, names ...string) struct{} {
+func addCommand(F func(m *Manager, w io.Writer, argv []string) error, help string, names ...string) struct{} {
 	commands = append(commands, commandMeta{
 		F:       F,
 		Help:    help,
@@ -185,11 +241,12 @@ func addCommand(F func(*Manager, []string), help string, names ...string) struct
 	return struct{}{}
 }
 
-func cmdHelp(m *Manager, argv []string) {
-	fmt.Println("Commands:")
+func cmdHelp(m *Manager, w io.Writer, argv []string) error {
+	fmt.Fprintln(w, "Commands:")
 	for _, v := range commands {
-		fmt.Printf("  %s - %s\n", v.Aliases[0], v.Help)
+		fmt.Fprintf(w, "  %s - %s\n", v.Aliases[0], v.Help)
 	}
+	return nil
 }
 
 var _ = addCommand(cmdHelp, "Display this help text.", "help", "?", "hlep")
@@ -197,6 +254,7 @@ var _ = addCommand(cmdList, "Show the names of all Joy-Cons connected to the sys
 var _ = addCommand(cmdSync, "Connect a new Joy-Con (turn on bluetooth discovery).", "sync")
 var _ = addCommand(cmdSyncOff, "Done connecting a new Joy-Con (turn off bluetooth discovery).", "syncoff")
 var _ = addCommand(cmdResetSync, "Reset Joy-Con pairing info.", "resetsync")
+var _ = addCommand(cmdAutoReconnect, "Turn reconnecting to known Joy-Cons on or off.", "autoreconnect")
 var _ = addCommand(cmdDisconnect, "Disconnect the specified JoyCon.", "disconnect")
 var _ = addCommand(cmdDisconnectAll, "Disconnect all JoyCons.", "disconnectall")
 var _ = addCommand(cmdSetPlayerLights, "Set the player lights on the JoyCon", "setPlayerLights")
@@ -205,137 +263,190 @@ var _ = addCommand(cmdEnableIMU, "Enable/disable IMU.", "imu")
 var _ = addCommand(cmdSPIDump, "Read from SPI flash.", "read")
 var _ = addCommand(cmdSPIWrite, "Write to SPI flash.", "write")
 var _ = addCommand(cmdCustomSend, "Send a subcommand packet.", "send")
+var _ = addCommand(cmdFilter, "Turn the turbo/toggle/macro layer on or off.", "filter")
+var _ = addCommand(cmdTurbo, "Set the autofire rate of a button.", "turbo")
+var _ = addCommand(cmdToggle, "Make a button latch on and off.", "toggle")
+var _ = addCommand(cmdMacro, "Record, set or clear a button macro.", "macro")
+var _ = addCommand(cmdOrient, "Set how a single Joy-Con is held.", "orient")
+var _ = addCommand(cmdLogLevel, "Show or change the log level of a component.", "loglevel")
+var _ = addCommand(cmdRumble, "Rumble a JoyCon.", "rumble")
+var _ = addCommand(cmdPair, "Pair unpaired JoyCons into a controller.", "pair")
+var _ = addCommand(cmdUnpair, "Return the JoyCons of a controller to the unpaired list.", "unpair")
+var _ = addCommand(cmdSplit, "Turn a pair of JoyCons into two single controllers.", "split")
+var _ = addCommand(cmdSwap, "Swap the player numbers of two controllers.", "swap")
+var _ = addCommand(cmdSlot, "Set the player number of a controller.", "slot")
+var _ = addCommand(cmdForget, "List or forget the controllers that are paired again on reconnect.", "forget")
+var _ = addCommand(cmdCalibrate, "Reload the stick calibration of a JoyCon.", "calibrate")
+
+func cmdList(m *Manager, w io.Writer, argv []string) error {
+	printConnectedJoyCons(m, w)
+	return nil
+}
 
-func cmdList(m *Manager, argv []string) {
-	printConnectedJoyCons(m)
+func cmdSync(m *Manager, w io.Writer, argv []string) error {
+	m.btManager.StartDiscovery()
+	fmt.Fprintln(w, "Searching for Bluetooth devices.")
+	fmt.Fprintln(w, "Hold the SYNC button on your Joy-Con to connect.")
+	fmt.Fprintln(w, "Remember to use the 'syncoff' command when done.")
+	return nil
 }
 
-func cmdSync(m *Manager, argv []string) {
-	go func() {
-		m.btManager.StartDiscovery()
-		fmt.Println("Searching for Bluetooth devices.")
-		fmt.Println("Hold the SYNC button on your Joy-Con to connect.")
-		fmt.Println("Remember to use the 'syncoff' command when done.")
-	}()
+func cmdSyncOff(m *Manager, w io.Writer, argv []string) error {
+	m.btManager.StopDiscovery()
+	fmt.Fprintln(w, "Stopped Bluetooth search.")
+	return nil
 }
 
-func cmdSyncOff(m *Manager, argv []string) {
-	go func() {
-		m.btManager.StopDiscovery()
-		fmt.Println("Stopped Bluetooth search.")
-	}()
+func cmdResetSync(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) > 1 {
+		return errors.New("specify at most one MAC address: resetsync [AA:BB:CC:DD:EE:FF]")
+	}
+	mac := ""
+	if len(argv) == 1 {
+		mac = argv[0]
+	}
+	removed, err := m.btManager.DeletePairingInfo(mac)
+	for _, mac := range removed {
+		fmt.Fprintf(w, "Deleted the pairing record of %s.\n", mac)
+	}
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		fmt.Fprintln(w, "No Joy-Con pairing records found.")
+	} else {
+		fmt.Fprintln(w, "Joy-Cons must be reconnected with the sync command.")
+	}
+	return nil
 }
 
-func cmdResetSync(m *Manager, argv []string) {
-	m.btManager.DeletePairingInfo()
-	fmt.Println("Deleted all pairing records, joy-cons must be reconnected.")
+func cmdAutoReconnect(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) == 0 {
+		if m.btManager.AutoReconnect() {
+			fmt.Fprintln(w, "Automatic reconnect is on.")
+		} else {
+			fmt.Fprintln(w, "Automatic reconnect is off.")
+		}
+		return nil
+	}
+	enable, ok := parseOnOff(argv[0])
+	if !ok {
+		return errors.New("specify on/off true/false")
+	}
+	return m.btManager.SetAutoReconnect(enable)
 }
 
-func cmdDisconnect(m *Manager, argv []string) {
+func cmdDisconnect(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
+	m.btManager.UserDisconnected(jc.Serial())
 	jc.Shutdown()
+	return nil
+}
+
+// parseByte accepts 0x08, x08 and 8.
+func parseByte(s string) (byte, error) {
+	var value uint64
+	var err error
+	if strings.HasPrefix(s, "x") {
+		value, err = strconv.ParseUint(s[1:], 16, 8)
+	} else {
+		value, err = strconv.ParseUint(s, 0, 8)
+	}
+	if err != nil {
+		return 0, errors.Errorf("invalid number %s", s)
+	}
+	return byte(value), nil
+}
+
+func parseBytes(argv []string) ([]byte, error) {
+	p := make([]byte, len(argv))
+	for i := range p {
+		val, err := parseByte(argv[i])
+		if err != nil {
+			return nil, err
+		}
+		p[i] = val
+	}
+	return p, nil
 }
 
-func cmdSetPlayerLights(m *Manager, argv []string) {
+func cmdSetPlayerLights(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
 	if len(argv) == 0 {
-		fmt.Println("must specify a value: setPlayerLights [jc] 0x8")
-		return
-	}
-	var value uint64
-	if strings.HasPrefix(argv[0], "x") {
-		value, err = strconv.ParseUint(argv[0][1:], 16, 8)
-	} else {
-		value, err = strconv.ParseUint(argv[0], 0, 8)
+		return errors.New("must specify a value: setPlayerLights [jc] 0x8")
 	}
+	value, err := parseByte(argv[0])
 	if err != nil {
-		fmt.Println("must specify a value: setPlayerLights [jc] 0x8")
-		fmt.Println(err)
-		return
+		return errors.Wrap(err, "must specify a value: setPlayerLights [jc] 0x8")
 	}
 
-	jcpc.SetPlayerLights(jc, byte(value))
+	jcpc.SetPlayerLights(jc, value)
+	return nil
 }
 
-func cmdSetHomeLights(m *Manager, argv []string) {
+func cmdSetHomeLights(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
 	if len(argv) == 0 {
-		fmt.Println("must specify a value: setHomeLights [jc] 0x8 0xFF ...")
-		return
+		return errors.New("must specify a value: setHomeLights [jc] 0x8 0xFF ...")
 	}
-
-	pattern := make([]byte, len(argv))
-	for i := range pattern {
-		val, err := strconv.ParseUint(argv[i], 0, 8)
-		if err != nil {
-			fmt.Println("invalid number", argv[i], err)
-		}
-		pattern[i] = byte(val)
+	pattern, err := parseBytes(argv)
+	if err != nil {
+		return err
 	}
 
 	jcpc.SetHomeLightPulse(jc, pattern)
+	return nil
 }
 
-func cmdEnableIMU(m *Manager, argv []string) {
+func cmdEnableIMU(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
 	if len(argv) == 0 {
-		fmt.Println("specify on/off true/false")
+		return errors.New("specify on/off true/false")
 	}
-
-	enable := false
-	switch argv[0] {
-	case "on", "1", "true", "enable":
-		enable = true
+	enable, ok := parseOnOff(argv[0])
+	if !ok {
+		return errors.New("specify on/off true/false")
 	}
 
 	jc.EnableGyro(enable)
+	return nil
 }
 
-func cmdCustomSend(m *Manager, argv []string) {
+func cmdCustomSend(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
 	if len(argv) == 0 {
-		fmt.Println("must specify a value: send [jc] 0x8 0xFF ...")
-		return
+		return errors.New("must specify a value: send [jc] 0x8 0xFF ...")
 	}
-
-	pattern := make([]byte, len(argv))
-	for i := range pattern {
-		val, err := strconv.ParseUint(argv[i], 0, 8)
-		if err != nil {
-			fmt.Println("invalid number", argv[i], err)
-		}
-		pattern[i] = byte(val)
+	pattern, err := parseBytes(argv)
+	if err != nil {
+		return err
 	}
 
 	jc.SendCustomSubcommand(pattern)
+	return nil
 }
 
-func cmdDisconnectAll(m *Manager, argv []string) {
+func cmdDisconnectAll(m *Manager, w io.Writer, argv []string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -343,86 +454,451 @@ func cmdDisconnectAll(m *Manager, argv []string) {
 		c.c.Close()
 		c.o.Close()
 		for _, jc := range c.jc {
+			m.btManager.UserDisconnected(jc.Serial())
 			jc.Shutdown()
 			jc.Close()
 		}
 	}
 	for _, up := range m.unpaired {
+		m.btManager.UserDisconnected(up.jc.Serial())
 		up.jc.Shutdown()
 		up.jc.Close()
 	}
 	m.paired = nil
 	m.unpaired = nil
-	fmt.Println("Disconnected all.")
+	fmt.Fprintln(w, "Disconnected all.")
+	return nil
+}
+
+// parseRange parses the start and size of an SPI flash range.
+func parseRange(argv []string) (start, size uint32, err error) {
+	s, err := strconv.ParseUint(argv[0], 0, 32)
+	if err != nil {
+		return 0, 0, errors.Errorf("numeric parse error '%s': %v", argv[0], err)
+	}
+	n, err := strconv.ParseUint(argv[1], 0, 32)
+	if err != nil {
+		return 0, 0, errors.Errorf("numeric parse error '%s': %v", argv[1], err)
+	}
+	err = jcpc.CheckSPIRange(uint32(s), uint32(n))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(s), uint32(n), nil
 }
 
-func cmdSPIDump(m *Manager, argv []string) {
+func cmdSPIDump(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
 	if len(argv) < 2 {
-		fmt.Println("please specify the range: read [jc] [start=0x6000] [size=0x0100] [outfile=stdout]")
-		return
+		return errors.New("please specify the range: read [jc] [start=0x6000] [size=0x0100]")
+	}
+	start, size, err := parseRange(argv)
+	if err != nil {
+		return err
 	}
 
-	start, err := strconv.ParseInt(argv[0], 0, 32)
+	b, err := jcpc.SPIFlashRead(jc, start, size)
 	if err != nil {
-		fmt.Printf("numeric parse error '%s': %v\n", argv[0], err)
-		return
+		return errors.Errorf("SPI read %06x %d error: %v", start, size, err)
 	}
-	size, err := strconv.ParseInt(argv[1], 0, 32)
+	fmt.Fprintf(w, "SPI read %06x %d data:\n%s\n", start, size, hex.Dump(b))
+	return nil
+}
+
+func cmdSPIWrite(m *Manager, w io.Writer, argv []string) error {
+	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Printf("numeric parse error '%s': %v\n", argv[1], err)
-		return
+		return err
 	}
 
-	b, err := jcpc.SPIFlashRead(jc, uint32(start), uint32(size))
+	if len(argv) < 3 {
+		return errors.New("please specify the range and data: write [jc] [start=0x6000] [size=2] 0x12 0x34")
+	}
+	start, size, err := parseRange(argv)
 	if err != nil {
-		fmt.Printf("SPI read %06x %d error: %v\n", start, size, err)
-	} else {
-		fmt.Printf("SPI read %06x %d data:\n%s\n", start, size, hex.Dump(b))
+		return err
+	}
+	if len(argv) != int(2+size) {
+		return errors.New("wrong number of data bytes")
+	}
+	pattern, err := parseBytes(argv[2:])
+	if err != nil {
+		return err
+	}
+
+	return jc.SPIWrite(start, pattern)
+}
+
+func parseOnOff(s string) (bool, bool) {
+	switch s {
+	case "on", "1", "true", "enable":
+		return true, true
+	case "off", "0", "false", "disable":
+		return false, true
+	}
+	return false, false
+}
+
+func cmdFilter(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	if len(argv) == 0 {
+		fmt.Fprintln(w, c.filter.Describe())
+		return nil
+	}
+	enable, ok := parseOnOff(argv[0])
+	if !ok {
+		return errors.New("specify on/off: filter [c] on")
+	}
+	c.filter.SetEnabled(enable)
+	return nil
+}
+
+func cmdTurbo(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	const usage = "must specify a button and rate: turbo [c] A 10"
+	if len(argv) < 2 {
+		return errors.New(usage)
+	}
+	b, ok := jcpc.ParseButton(argv[0])
+	if !ok {
+		return errors.Errorf("unknown button %s", argv[0])
+	}
+	rate := 0
+	if argv[1] != "off" {
+		rate, err = strconv.Atoi(argv[1])
+		if err != nil || rate < 0 {
+			return errors.New(usage)
+		}
+	}
+	c.filter.SetTurbo(b, rate)
+	return nil
+}
+
+func cmdToggle(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	const usage = "must specify a button and on/off: toggle [c] ZR on"
+	if len(argv) < 2 {
+		return errors.New(usage)
+	}
+	b, ok := jcpc.ParseButton(argv[0])
+	if !ok {
+		return errors.Errorf("unknown button %s", argv[0])
+	}
+	enable, ok := parseOnOff(argv[1])
+	if !ok {
+		return errors.New(usage)
 	}
+	c.filter.SetToggle(b, enable)
+	return nil
 }
 
-func cmdSPIWrite(m *Manager, argv []string) {
+func cmdMacro(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	const usage = "usage: macro [c] record [button] | stop | clear [button] | set [button] press:A wait:5 release:A ..."
+	if len(argv) == 0 {
+		return errors.New(usage)
+	}
+	switch argv[0] {
+	case "stop":
+		b, macro, err := c.filter.StopRecording()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Recorded macro for %s: %s\n", b, macro)
+		return nil
+	case "record", "clear", "set":
+	default:
+		return errors.New(usage)
+	}
+
+	if len(argv) < 2 {
+		return errors.New(usage)
+	}
+	b, ok := jcpc.ParseButton(argv[1])
+	if !ok {
+		return errors.Errorf("unknown button %s", argv[1])
+	}
+	switch argv[0] {
+	case "record":
+		c.filter.StartRecording(b)
+		fmt.Fprintf(w, "Recording macro for %s, use 'macro c.. stop' when done.\n", b)
+	case "clear":
+		c.filter.SetMacro(b, nil)
+	case "set":
+		macro, err := output.ParseMacro(strings.Join(argv[2:], " "))
+		if err != nil {
+			return err
+		}
+		c.filter.SetMacro(b, macro)
+	}
+	return nil
+}
+
+func cmdOrient(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+	oc, ok := c.c.(jcpc.OrientableController)
+	if !ok {
+		return errors.New("orientation can only be set for a single Joy-Con")
+	}
+
+	if len(argv) == 0 {
+		fmt.Fprintln(w, oc.Orientation())
+		return nil
+	}
+	orient, ok := jcpc.ParseOrientation(argv[0])
+	if !ok {
+		return errors.New("specify an orientation: orient [c] sideways|vertical|upside-down")
+	}
+	oc.SetOrientation(orient)
+	m.mu.Lock()
+	m.rememberGroup(c.jc, orient.String())
+	m.mu.Unlock()
+	return nil
+}
+
+func cmdLogLevel(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) == 0 {
+		for _, c := range jclog.Components() {
+			fmt.Fprintf(w, "  %s: %s\n", c, jclog.GetLevel(c))
+		}
+		return nil
+	}
+	if len(argv) != 2 {
+		return errors.New("specify a component and level: loglevel [all|bluez|joycon|output|manager|...] [debug|info|warn|error|off]")
+	}
+	level, err := jclog.ParseLevel(argv[1])
+	if err != nil {
+		return err
+	}
+	return jclog.SetLevel(argv[0], level)
+}
+
+func cmdRumble(m *Manager, w io.Writer, argv []string) error {
 	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
+	const usage = "specify the strength (0-65535) of the low and high frequency motors and the duration: rumble [jc] 40000 20000 500ms"
 	if len(argv) < 3 {
-		fmt.Println("please specify the range: read [jc] [start=0x6000] [size=0x0100] [outfile=stdout]")
-		return
+		return errors.New(usage)
+	}
+	strong, err := strconv.ParseUint(argv[0], 0, 16)
+	if err != nil {
+		return errors.New(usage)
+	}
+	weak, err := strconv.ParseUint(argv[1], 0, 16)
+	if err != nil {
+		return errors.New(usage)
+	}
+	d, err := time.ParseDuration(argv[2])
+	if err != nil {
+		return errors.New(usage)
+	}
+	rumble(jc, uint16(strong), uint16(weak), d)
+	return nil
+}
+
+// rumble queues a rumble of the given duration, followed by silence.
+func rumble(jc jcpc.JoyCon, strong, weak uint16, d time.Duration) {
+	frames := int(d / (16666 * time.Microsecond))
+	if frames < 1 {
+		frames = 1
 	}
+	jc.Rumble([]jcpc.RumbleData{jcpc.RumbleFromMagnitude(strong, weak, frames), jcpc.RumbleDataNeutral})
+}
 
-	start, err := strconv.ParseInt(argv[0], 0, 32)
+func cmdCalibrate(m *Manager, w io.Writer, argv []string) error {
+	jc, argv, err := selectJoyCon(m, argv)
 	if err != nil {
-		fmt.Printf("numeric parse error '%s': %v\n", argv[0], err)
-		return
+		return err
 	}
-	size, err := strconv.ParseInt(argv[1], 0, 32)
+
+	err = jc.ReloadCalibration()
 	if err != nil {
-		fmt.Printf("numeric parse error '%s': %v\n", argv[1], err)
-		return
+		return err
+	}
+	var st jcpc.CombinedState
+	jc.ReadInto(&st, false)
+	raw := jc.RawSticks()
+	for side, name := range []string{"left", "right"} {
+		if (side == 0 && !jc.Type().IsLeft()) || (side == 1 && !jc.Type().IsRight()) {
+			continue
+		}
+		fmt.Fprintf(w, "%s stick: raw %d %d, calibrated %+d %+d\n", name,
+			raw[side][0], raw[side][1], st.AdjSticks[side][0], st.AdjSticks[side][1])
 	}
+	return nil
+}
 
-	if len(argv) != int(2+size) {
-		fmt.Println("wrong number of data bytes")
-		return
+func cmdPair(m *Manager, w io.Writer, argv []string) error {
+	const usage = "specify a left and right JoyCon, or one JoyCon or Pro Controller: pair [u1] [u2|single]"
+	if len(argv) == 2 && argv[1] == "single" {
+		argv = argv[:1]
+	}
+	if len(argv) < 1 || len(argv) > 2 {
+		return errors.New(usage)
 	}
 
-	pattern := make([]byte, size)
-	for i := range pattern {
-		val, err := strconv.ParseUint(argv[2+i], 0, 8)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, err := m.pairNames_(argv)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Paired c%d as player %d.\n", idx+1, m.paired[idx].pNum)
+	return nil
+}
+
+func cmdUnpair(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unpair_(c.c)
+}
+
+func cmdSplit(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = m.split_(c.c)
+	if err != nil {
+		return err
+	}
+	for i, v := range m.paired[len(m.paired)-2:] {
+		fmt.Fprintf(w, "c%d: %s, player %d\n", len(m.paired)-1+i, v.jc[0].Type(), v.pNum)
+	}
+	return nil
+}
+
+func cmdSwap(m *Manager, w io.Writer, argv []string) error {
+	c1, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+	c2, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx1, idx2 := m.pairedIndex(c1.c), m.pairedIndex(c2.c)
+	if idx1 == -1 || idx2 == -1 {
+		return errors.New("controller was removed")
+	}
+	return m.setPlayer_(idx1, m.paired[idx2].pNum)
+}
+
+func cmdSlot(m *Manager, w io.Writer, argv []string) error {
+	c, argv, err := selectController(m, argv)
+	if err != nil {
+		return err
+	}
+
+	const usage = "specify a player number, or auto to forget it: slot [c] 2"
+	if len(argv) != 1 {
+		return errors.New(usage)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx := m.pairedIndex(c.c)
+	if idx == -1 {
+		return errors.New("controller was removed")
+	}
+	if argv[0] == "auto" {
+		m.setPreferredSlot(c.jc, 0)
+		return nil
+	}
+	pNum, err := strconv.Atoi(argv[0])
+	if err != nil {
+		return errors.New(usage)
+	}
+	return m.setPlayer_(idx, pNum)
+}
+
+func cmdForget(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) == 0 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if len(m.state.Groups) == 0 {
+			fmt.Fprintln(w, "No controllers remembered.")
+		}
+		for _, g := range m.state.Groups {
+			if g.Orientation != "" {
+				fmt.Fprintf(w, "  %s (%s)\n", strings.Join(g.Serials, " + "), g.Orientation)
+			} else {
+				fmt.Fprintf(w, "  %s\n", strings.Join(g.Serials, " + "))
+			}
+		}
+		return nil
+	}
+	if len(argv) != 1 {
+		return errors.New("specify a controller, a serial number or all: forget [c1|serial|all]")
+	}
+
+	if argv[0] == "all" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.state.Groups = nil
+		m.saveState()
+		return nil
+	}
+
+	var serials []string
+	if rgxSelectController.MatchString(argv[0]) {
+		c, _, err := selectController(m, argv)
 		if err != nil {
-			fmt.Println("invalid number", argv[2+i], err)
+			return err
 		}
-		pattern[i] = byte(val)
+		for _, jc := range c.jc {
+			serials = append(serials, jc.Serial())
+		}
+	} else {
+		serials = argv
 	}
 
-	fmt.Println(jc.SPIWrite(uint32(start), pattern))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for _, serial := range serials {
+		if m.forgetGroup(serial) {
+			found = true
+		}
+	}
+	if !found {
+		return errors.Errorf("%s is not remembered", argv[0])
+	}
+	return nil
 }
@@ -0,0 +1,211 @@
+package consoleiface
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/control"
+)
+
+var _ = addCommand(cmdSource, "Run the console commands in a file.", "source")
+var _ = addCommand(cmdSleep, "Wait for some time, e.g. sleep 500ms.", "sleep")
+var _ = addCommand(cmdWaitFor, "Wait until a JoyCon or controller is connected.", "wait-for")
+
+// How deep scripts may source other scripts
+const maxScriptDepth = 8
+
+// scriptWriter is the output of the commands in a script, so that source
+// can tell how deeply it is nested.
+type scriptWriter struct {
+	io.Writer
+	depth int
+}
+
+// RunScript runs the console commands in a file, one per line, stopping at
+// the first one that fails.  Blank lines and lines starting with # are
+// skipped.  $name and ${name} are replaced by the entries of vars.
+func (m *Manager) RunScript(w io.Writer, path string, vars map[string]string) error {
+	depth := 1
+	if sw, ok := w.(*scriptWriter); ok {
+		depth = sw.depth + 1
+		w = sw.Writer
+	}
+	if depth > maxScriptDepth {
+		return errors.Errorf("%s: scripts nested too deeply", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sw := &scriptWriter{Writer: w, depth: depth}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = os.Expand(text, func(name string) string {
+			if v, ok := vars[name]; ok {
+				return v
+			}
+			return "$" + name
+		})
+		err = m.RunCommand(sw, strings.Fields(text))
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", path, line)
+		}
+	}
+	return s.Err()
+}
+
+// eventVars returns the variables for a script or hook run on an event:
+// event, name, type, serial, player, battery and charging, where they
+// apply.
+func eventVars(ev control.Event) map[string]string {
+	var vars map[string]string
+	switch {
+	case ev.JoyCon != nil:
+		vars = joyConVars(*ev.JoyCon)
+	case ev.Controller != nil:
+		vars = controllerVars(*ev.Controller)
+	default:
+		vars = make(map[string]string)
+	}
+	vars["event"] = ev.Type
+	return vars
+}
+
+func joyConVars(jc control.JoyConInfo) map[string]string {
+	return map[string]string{
+		"name":     jc.Name,
+		"type":     jc.Type,
+		"serial":   jc.Serial,
+		"battery":  strconv.Itoa(int(jc.Battery)),
+		"charging": strconv.FormatBool(jc.Charging),
+	}
+}
+
+// controllerVars identifies a controller by the serials of its JoyCons
+// joined with "+".
+func controllerVars(c control.ControllerInfo) map[string]string {
+	var serials []string
+	for _, jc := range c.JoyCons {
+		serials = append(serials, jc.Serial)
+	}
+	return map[string]string{
+		"name":   c.Name,
+		"type":   c.Type,
+		"serial": strings.Join(serials, "+"),
+		"player": strconv.Itoa(c.Player),
+	}
+}
+
+// runEventScript runs the script configured for an event, if any.
+//
+// must be called locked
+func (m *Manager) runEventScript(ev control.Event) {
+	path := m.options.Scripts[ev.Type]
+	if path == "" {
+		return
+	}
+	vars := eventVars(ev)
+	go func() {
+		err := m.RunScript(os.Stdout, path, vars)
+		if err != nil {
+			log.With("event", ev.Type).Warnf("script failed: %v", err)
+		}
+	}()
+}
+
+func cmdSource(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("specify a file: source <file> [args...]")
+	}
+	vars := make(map[string]string)
+	for i, arg := range argv[1:] {
+		vars[strconv.Itoa(i+1)] = arg
+	}
+	return m.RunScript(w, argv[0], vars)
+}
+
+func cmdSleep(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) != 1 {
+		return errors.New("specify a duration: sleep 500ms")
+	}
+	d, err := parseDuration(argv[0])
+	if err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return nil
+}
+
+// parseDuration accepts 500ms, 2s and 2 (seconds).
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(n * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid duration %s", s)
+	}
+	return d, nil
+}
+
+var rgxJoyConName = regexp.MustCompile(`^(u[0-9]+|c[0-9]+[lr]?)$`)
+
+func cmdWaitFor(m *Manager, w io.Writer, argv []string) error {
+	if len(argv) < 1 || len(argv) > 2 {
+		return errors.New("specify a JoyCon name or serial number: wait-for c1|u2|<serial> [timeout]")
+	}
+	var deadline time.Time
+	if len(argv) == 2 {
+		d, err := parseDuration(argv[1])
+		if err != nil {
+			return err
+		}
+		deadline = time.Now().Add(d)
+	}
+
+	for !m.isConnected(argv[0]) {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for %s", argv[0])
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// isConnected reports whether a JoyCon with the given serial number or name
+// is connected.
+func (m *Manager) isConnected(sel string) bool {
+	if rgxJoyConName.MatchString(sel) {
+		_, _, err := selectJoyCon(m, []string{sel})
+		return err == nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, up := range m.unpaired {
+		if up.jc.Serial() == sel {
+			return true
+		}
+	}
+	for _, c := range m.paired {
+		for _, jc := range c.jc {
+			if jc.Serial() == sel {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package consoleiface
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// savedState is what the driver remembers across restarts, in the file
+// given to LoadState.  Unlike the options, it is changed by console
+// commands.
+type savedState struct {
+	// Preferred player number by controllerKey
+	Slots map[string]int `json:"slots,omitempty"`
+	// Controllers to pair again when their JoyCons connect
+	Groups []savedGroup `json:"groups,omitempty"`
+}
+
+// savedGroup is a controller that was paired before.
+type savedGroup struct {
+	// Serial numbers, left first for a pair
+	Serials []string `json:"serials"`
+	// How a single Joy-Con was held
+	Orientation string `json:"orientation,omitempty"`
+}
+
+// controllerKey identifies the JoyCons of a controller in the saved state:
+// the serial number, or the serials of a pair joined with "+", left first.
+func controllerKey(jcs []jcpc.JoyCon) string {
+	var serials []string
+	for _, jc := range jcs {
+		serials = append(serials, jc.Serial())
+	}
+	if len(jcs) == 2 && !jcs[0].Type().IsLeft() {
+		serials[0], serials[1] = serials[1], serials[0]
+	}
+	return strings.Join(serials, "+")
+}
+
+// LoadState reads the saved state from path, and saves it there when it
+// changes.  A missing file is not an error.
+func (m *Manager) LoadState(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.statePath = path
+	p, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "reading state")
+	}
+	err = json.Unmarshal(p, &m.state)
+	if err != nil {
+		return errors.Wrapf(err, "%s", path)
+	}
+	return nil
+}
+
+// saveState writes the saved state, if there is a state file.
+//
+// must be called locked
+func (m *Manager) saveState() {
+	if m.statePath == "" {
+		return
+	}
+	err := writeFileAtomic(m.statePath, m.state)
+	if err != nil {
+		log.Warnf("could not save state: %v", err)
+	}
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	p, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, append(p, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// setPreferredSlot remembers the player number of a controller, or forgets
+// it if pNum is 0.
+//
+// must be called locked
+func (m *Manager) setPreferredSlot(jcs []jcpc.JoyCon, pNum int) {
+	key := controllerKey(jcs)
+	if pNum == 0 {
+		delete(m.state.Slots, key)
+	} else {
+		if m.state.Slots == nil {
+			m.state.Slots = make(map[string]int)
+		}
+		m.state.Slots[key] = pNum
+	}
+	m.saveState()
+}
+
+// findGroup returns the index of the remembered group containing serial, or
+// -1.
+//
+// must be called locked
+func (m *Manager) findGroup(serial string) int {
+	for i, g := range m.state.Groups {
+		for _, s := range g.Serials {
+			if s == serial {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// rememberGroup records that jcs were paired as one controller, replacing
+// the groups they were in before.  orientation is only kept for a single
+// Joy-Con.
+//
+// must be called locked
+func (m *Manager) rememberGroup(jcs []jcpc.JoyCon, orientation string) {
+	g := savedGroup{Serials: strings.Split(controllerKey(jcs), "+")}
+	if len(jcs) == 1 && !jcs[0].Type().IsBoth() {
+		g.Orientation = orientation
+	}
+	for _, jc := range jcs {
+		m.removeGroup(jc.Serial())
+	}
+	m.state.Groups = append(m.state.Groups, g)
+	m.saveState()
+}
+
+// forgetGroup forgets the group containing serial and reports whether there
+// was one.
+//
+// must be called locked
+func (m *Manager) forgetGroup(serial string) bool {
+	if !m.removeGroup(serial) {
+		return false
+	}
+	m.saveState()
+	return true
+}
+
+// must be called locked
+func (m *Manager) removeGroup(serial string) bool {
+	idx := m.findGroup(serial)
+	if idx == -1 {
+		return false
+	}
+	m.state.Groups = append(m.state.Groups[:idx], m.state.Groups[idx+1:]...)
+	return true
+}
@@ -0,0 +1,327 @@
+package consoleiface
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+var _ = addCommand(cmdWatch, "Show the live state of the controllers, press q to exit.", "watch")
+
+const (
+	watchRefresh = 100 * time.Millisecond
+
+	// switch to the alternate screen and hide the cursor, and back
+	screenEnter = "\033[?1049h\033[?25l"
+	screenLeave = "\033[?25h\033[?1049l"
+	screenHome  = "\033[H"
+	clearLine   = "\033[K"
+	clearBelow  = "\033[J"
+	colorPress  = "\033[7m"
+
+	// size of the stick plots
+	plotRows = 9
+	plotCols = 19
+
+	// IMU values at the ends of the bars, about 2g and 500°/s
+	imuBarRange = 8192
+	imuBarWidth = 21
+)
+
+var watchButtonsL = []jcpc.ButtonID{
+	jcpc.Button_L_ZL, jcpc.Button_L_L, jcpc.Button_L_SL, jcpc.Button_L_SR,
+	jcpc.Button_Minus, jcpc.Button_Capture, jcpc.Button_L_Stick,
+	jcpc.Button_L_Up, jcpc.Button_L_Down, jcpc.Button_L_Left, jcpc.Button_L_Right,
+}
+
+var watchButtonsR = []jcpc.ButtonID{
+	jcpc.Button_R_ZR, jcpc.Button_R_R, jcpc.Button_R_SL, jcpc.Button_R_SR,
+	jcpc.Button_Plus, jcpc.Button_Home, jcpc.Button_R_Stick,
+	jcpc.Button_R_X, jcpc.Button_R_B, jcpc.Button_R_Y, jcpc.Button_R_A,
+}
+
+var imuNames = [6]string{"accel X", "accel Y", "accel Z", "gyro X ", "gyro Y ", "gyro Z "}
+
+// dashboard counts the input reports for the watch command.
+type dashboard struct {
+	// reports since lastRate, counted by JoyConUpdate
+	reports  map[jcpc.JoyCon]int
+	rates    map[jcpc.JoyCon]int
+	lastRate time.Time
+}
+
+type watchEntry struct {
+	name string
+	jc   jcpc.JoyCon
+}
+
+// cmdWatch takes over the terminal until q is pressed.  Readline only reads
+// from stdin while it is waiting for a line, so the keys come to us.
+func cmdWatch(m *Manager, w io.Writer, argv []string) error {
+	if w != io.Writer(os.Stdout) {
+		return errors.New("watch only works at the console")
+	}
+	var only jcpc.JoyCon
+	if len(argv) > 0 {
+		jc, _, err := selectJoyCon(m, argv)
+		if err != nil {
+			return err
+		}
+		only = jc
+	}
+
+	fd := int(os.Stdin.Fd())
+	termState, err := readline.MakeRaw(fd)
+	if err != nil {
+		return errors.Wrap(err, "watch needs a terminal")
+	}
+	defer readline.Restore(fd, termState)
+
+	quit := make(chan struct{})
+	go waitForQuitKey(quit)
+
+	d := &dashboard{
+		reports:  make(map[jcpc.JoyCon]int),
+		rates:    make(map[jcpc.JoyCon]int),
+		lastRate: time.Now(),
+	}
+	m.mu.Lock()
+	m.dashboard = d
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.dashboard = nil
+		m.mu.Unlock()
+	}()
+
+	os.Stdout.WriteString(screenEnter)
+	defer os.Stdout.WriteString(screenLeave)
+
+	ticker := time.NewTicker(watchRefresh)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	for {
+		buf.Reset()
+		buf.WriteString(screenHome)
+		m.mu.Lock()
+		d.render(&buf, m, only)
+		m.mu.Unlock()
+		buf.WriteString(clearBelow)
+		os.Stdout.Write(buf.Bytes())
+
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForQuitKey closes quit when q or Ctrl-C is pressed.  It does not read
+// any further, so that the next key goes to readline.
+func waitForQuitKey(quit chan struct{}) {
+	var b [1]byte
+	for {
+		n, err := os.Stdin.Read(b[:])
+		if err != nil || (n == 1 && (b[0] == 'q' || b[0] == 'Q' || b[0] == readline.CharInterrupt)) {
+			close(quit)
+			return
+		}
+	}
+}
+
+// countReport is called from JoyConUpdate, locked.
+func (d *dashboard) countReport(jc jcpc.JoyCon) {
+	d.reports[jc]++
+}
+
+// must be called locked
+func (d *dashboard) render(w *bytes.Buffer, m *Manager, only jcpc.JoyCon) {
+	if elapsed := time.Since(d.lastRate); elapsed >= time.Second {
+		d.rates = make(map[jcpc.JoyCon]int)
+		for jc, n := range d.reports {
+			d.rates[jc] = int(float64(n)/elapsed.Seconds() + 0.5)
+		}
+		d.reports = make(map[jcpc.JoyCon]int)
+		d.lastRate = time.Now()
+	}
+
+	var entries []watchEntry
+	for i, c := range m.paired {
+		if len(c.jc) == 2 {
+			entries = append(entries,
+				watchEntry{fmt.Sprintf("c%dl", i+1), c.jc[0]},
+				watchEntry{fmt.Sprintf("c%dr", i+1), c.jc[1]})
+		} else {
+			entries = append(entries, watchEntry{fmt.Sprintf("c%d", i+1), c.jc[0]})
+		}
+	}
+	for i, up := range m.unpaired {
+		entries = append(entries, watchEntry{fmt.Sprintf("u%d", i+1), up.jc})
+	}
+
+	writeLine(w, "\033[1mjcdriver watch\033[0m - press q to return to the console")
+	writeLine(w, "")
+	shown := 0
+	for _, e := range entries {
+		if only != nil && e.jc != only {
+			continue
+		}
+		d.renderJoyCon(w, e)
+		shown++
+	}
+	if shown == 0 {
+		if only != nil {
+			writeLine(w, "The JoyCon has disconnected.")
+		} else {
+			writeLine(w, "No JoyCons connected.")
+		}
+	}
+}
+
+func (d *dashboard) renderJoyCon(w *bytes.Buffer, e watchEntry) {
+	jc := e.jc
+	var st jcpc.CombinedState
+	jc.ReadInto(&st, true)
+	buttons := jc.Buttons()
+	raw := jc.RawSticks()
+
+	writeLine(w, fmt.Sprintf("\033[1m%s\033[0m: %s %s %s  mode: %s  %d Hz",
+		e.name, jc.Type().String(), jc.Serial(), renderBattery(jc.Battery()),
+		jc.InputMode(), d.rates[jc]))
+	writeLine(w, fmt.Sprintf("  case %s  buttons %s", renderColor(jc.CaseColor()), renderColor(jc.ButtonColor())))
+
+	var sides []int
+	var line bytes.Buffer
+	line.WriteString(" ")
+	if jc.Type().IsLeft() {
+		sides = append(sides, 0)
+		renderButtons(&line, buttons, watchButtonsL)
+	}
+	if jc.Type().IsRight() {
+		sides = append(sides, 1)
+		renderButtons(&line, buttons, watchButtonsR)
+	}
+	writeLine(w, line.String())
+
+	// stick plots side by side, with the values next to them
+	var plots [][]string
+	var labels [][]string
+	for _, side := range sides {
+		x, y := st.AdjSticks[side][0], st.AdjSticks[side][1]
+		plots = append(plots, stickPlot(x, y))
+		labels = append(labels, []string{
+			[]string{"left stick", "right stick"}[side],
+			fmt.Sprintf("cal %+5d %+5d", x, y),
+			fmt.Sprintf("raw %5d %5d", raw[side][0], raw[side][1]),
+		})
+	}
+	for row := 0; row < plotRows; row++ {
+		line.Reset()
+		for i := range plots {
+			line.WriteString("  ")
+			line.WriteString(plots[i][row])
+			label := ""
+			if row < len(labels[i]) {
+				label = labels[i][row]
+			}
+			fmt.Fprintf(&line, " %-16s", label)
+		}
+		writeLine(w, line.String())
+	}
+
+	imu := st.Gyro[2]
+	if imu == (jcpc.GyroFrame{}) {
+		writeLine(w, "  IMU off, turn it on with 'imu "+e.name+" on'")
+	} else {
+		for i, name := range imuNames {
+			writeLine(w, fmt.Sprintf("  %s %+6d %s", name, imu[i], imuBar(imu[i])))
+		}
+	}
+	writeLine(w, "")
+}
+
+// writeLine writes a line for the raw mode terminal.
+func writeLine(w *bytes.Buffer, s string) {
+	w.WriteString(s)
+	w.WriteString(clearLine)
+	w.WriteString("\r\n")
+}
+
+func renderButtons(w *bytes.Buffer, state jcpc.ButtonState, list []jcpc.ButtonID) {
+	for _, b := range list {
+		w.WriteString(" ")
+		if state.Get(b) {
+			w.WriteString(colorPress)
+		}
+		w.WriteString(" " + b.String() + " ")
+		if state.Get(b) {
+			w.WriteString(colorReset)
+		}
+	}
+}
+
+func renderColor(c color.RGBA) string {
+	if c.A == 0 {
+		return "(unknown)"
+	}
+	return fmt.Sprintf("\033[48;2;%d;%d;%dm    %s #%02X%02X%02X", c.R, c.G, c.B, colorReset, c.R, c.G, c.B)
+}
+
+// stickPlot draws the stick position in a circle.
+func stickPlot(x, y int16) []string {
+	const cx, cy = plotCols / 2, plotRows / 2
+	px := cx + int(math.Floor(float64(x)/0x7FF*cx+0.5))
+	py := cy - int(math.Floor(float64(y)/0x7FF*cy+0.5))
+
+	rows := make([]string, plotRows)
+	for row := 0; row < plotRows; row++ {
+		var line bytes.Buffer
+		for col := 0; col < plotCols; col++ {
+			nx := float64(col-cx) / cx
+			ny := float64(row-cy) / cy
+			r := math.Sqrt(nx*nx + ny*ny)
+			switch {
+			case col == px && row == py:
+				line.WriteString(colorGood + "@" + colorReset)
+			case col == cx && row == cy:
+				line.WriteByte('+')
+			case math.Abs(r-1) < 0.15:
+				line.WriteByte('.')
+			default:
+				line.WriteByte(' ')
+			}
+		}
+		rows[row] = line.String()
+	}
+	return rows
+}
+
+// imuBar draws a bar from the center to the value.
+func imuBar(v int16) string {
+	const half = imuBarWidth / 2
+	n := int(v) * half / imuBarRange
+	if n > half {
+		n = half
+	} else if n < -half {
+		n = -half
+	}
+	bar := []byte(strings.Repeat(" ", imuBarWidth))
+	bar[half] = '|'
+	for i := 1; i <= n; i++ {
+		bar[half+i] = '#'
+	}
+	for i := -1; i >= n; i-- {
+		bar[half+i] = '#'
+	}
+	return "[" + string(bar) + "]"
+}
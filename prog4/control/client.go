@@ -0,0 +1,128 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Client is a connection to the control socket.  It is not safe for
+// concurrent use.
+type Client struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int
+	// received while waiting for a response
+	events []Event
+}
+
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), nextID: 1}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Call sends a request and waits for its response.  params may be nil.  If
+// result is not nil, the result is unmarshaled into it.  Errors reported by
+// the driver are of type *Error.
+func (c *Client) Call(method string, params, result interface{}) error {
+	id := json.RawMessage(strconv.Itoa(c.nextID))
+	c.nextID++
+	req := Request{JSONRPC: "2.0", ID: &id, Method: method}
+	if params != nil {
+		p, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = p
+	}
+	p, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(append(p, '\n'))
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, ev, err := c.read()
+		if err != nil {
+			return err
+		}
+		if ev != nil {
+			c.events = append(c.events, *ev)
+			continue
+		}
+		if resp.ID == nil || string(*resp.ID) != string(id) {
+			// the driver could not parse the request
+			if resp.Error != nil {
+				return resp.Error
+			}
+			continue
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	}
+}
+
+// NextEvent waits for an event.  Call Subscribe first.
+func (c *Client) NextEvent() (Event, error) {
+	for len(c.events) == 0 {
+		_, ev, err := c.read()
+		if err != nil {
+			return Event{}, err
+		}
+		if ev != nil {
+			c.events = append(c.events, *ev)
+		}
+	}
+	ev := c.events[0]
+	c.events = c.events[1:]
+	return ev, nil
+}
+
+// Subscribe asks for events of the given types, or all of them.
+func (c *Client) Subscribe(events ...string) error {
+	return c.Call(MethodSubscribe, SubscribeParams{Events: events}, nil)
+}
+
+// read returns the next response or event.
+func (c *Client) read() (*Response, *Event, error) {
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	var msg struct {
+		Response
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	err = json.Unmarshal(line, &msg)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "control: bad message from driver")
+	}
+	if msg.Method == MethodEvent {
+		var ev Event
+		err = json.Unmarshal(msg.Params, &ev)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "control: bad event from driver")
+		}
+		return nil, &ev, nil
+	}
+	return &msg.Response, nil, nil
+}
@@ -0,0 +1,198 @@
+// Package control lets other programs manage the driver over a Unix-domain
+// socket, for example to build a graphical interface.
+//
+// The protocol is JSON-RPC 2.0, one JSON object per line in each direction:
+//
+//	-> {"jsonrpc":"2.0","id":1,"method":"list"}
+//	<- {"jsonrpc":"2.0","id":1,"result":{"unpaired":[...],"paired":[...]}}
+//
+// JoyCons and controllers are named like at the console: "u1" is the first
+// unpaired JoyCon, "c1" the first controller and "c1l" / "c1r" its halves.
+// The methods and their parameters are listed with the Method constants.
+//
+// After "subscribe", the server also sends notifications with the method
+// "event" and an Event as params.
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultPath is the suggested path of the socket.
+const DefaultPath = "/run/jcdriver.sock"
+
+// Methods.  The comments name the type of the params and of the result.
+const (
+	// none -> ListResult
+	MethodList = "list"
+	// PairParams -> ControllerInfo
+	MethodPair = "pair"
+	// ControllerParams -> ListResult, the JoyCons are unpaired again
+	MethodUnpair = "unpair"
+	// LightsParams -> nothing
+	MethodLights = "lights"
+	// RumbleParams -> nothing
+	MethodRumble = "rumble"
+	// none -> nothing
+	MethodStartSync = "startSync"
+	MethodStopSync  = "stopSync"
+	// SPIReadParams -> SPIReadResult
+	MethodSPIRead = "spiRead"
+	// SPIWriteParams -> nothing
+	MethodSPIWrite = "spiWrite"
+	// CommandParams -> CommandResult, runs any console command but source
+	MethodCommand = "command"
+	// SubscribeParams -> nothing
+	MethodSubscribe   = "subscribe"
+	MethodUnsubscribe = "unsubscribe"
+
+	// notification sent by the server
+	MethodEvent = "event"
+)
+
+// Error codes.  The codes below -32000 are defined by JSON-RPC.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	// The driver could not do what was asked, e.g. no such JoyCon.
+	CodeFailed = 1
+)
+
+// Event types.
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventPaired       = "paired"
+	EventUnpaired     = "unpaired"
+	EventBattery      = "battery"
+)
+
+type Request struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type Response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// Notification is a request without an ID, sent by the server.
+type Notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// JoyConInfo describes a connected JoyCon.
+type JoyConInfo struct {
+	// u1, c1, c1l, ...
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Serial string `json:"serial"`
+	// 4=full to 0=empty
+	Battery  int8 `json:"battery"`
+	Charging bool `json:"charging,omitempty"`
+	// "#RRGGBB", empty until read from the JoyCon
+	CaseColor   string `json:"case_color,omitempty"`
+	ButtonColor string `json:"button_color,omitempty"`
+}
+
+// ControllerInfo describes a paired controller.
+type ControllerInfo struct {
+	// c1, c2, ...
+	Name    string       `json:"name"`
+	Player  int          `json:"player"`
+	Type    string       `json:"type"`
+	JoyCons []JoyConInfo `json:"joycons"`
+}
+
+type ListResult struct {
+	Unpaired []JoyConInfo     `json:"unpaired"`
+	Paired   []ControllerInfo `json:"paired"`
+}
+
+// PairParams names one unpaired Pro Controller or JoyCon, or an unpaired
+// left and right JoyCon.
+type PairParams struct {
+	JoyCons []string `json:"joycons"`
+}
+
+type ControllerParams struct {
+	Controller string `json:"controller"`
+}
+
+type LightsParams struct {
+	JoyCon string `json:"joycon"`
+	// see jcpc.SetPlayerLights
+	Pattern byte `json:"pattern"`
+}
+
+type RumbleParams struct {
+	JoyCon string `json:"joycon"`
+	// strength of the low and high frequency, 0 to 65535
+	Strong uint16 `json:"strong"`
+	Weak   uint16 `json:"weak"`
+	// in milliseconds
+	Duration int `json:"duration"`
+}
+
+type SPIReadParams struct {
+	JoyCon  string `json:"joycon"`
+	Address uint32 `json:"address"`
+	Size    uint32 `json:"size"`
+}
+
+type SPIReadResult struct {
+	// base64 in JSON
+	Data []byte `json:"data"`
+}
+
+type SPIWriteParams struct {
+	JoyCon  string `json:"joycon"`
+	Address uint32 `json:"address"`
+	Data    []byte `json:"data"`
+}
+
+// CommandParams is a console command and its arguments, e.g.
+// ["turbo", "c1", "A", "10"].
+type CommandParams struct {
+	Args []string `json:"args"`
+}
+
+// CommandResult is what the command printed.
+type CommandResult struct {
+	Output string `json:"output"`
+}
+
+// SubscribeParams selects the event types to receive, or all of them if
+// Events is empty.
+type SubscribeParams struct {
+	Events []string `json:"events,omitempty"`
+}
+
+// Event is sent to subscribers.  Only the fields relevant to the Type are
+// present.
+type Event struct {
+	Type string `json:"type"`
+	// connected, disconnected, battery
+	JoyCon *JoyConInfo `json:"joycon,omitempty"`
+	// paired, unpaired
+	Controller *ControllerInfo `json:"controller,omitempty"`
+}
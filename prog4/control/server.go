@@ -0,0 +1,304 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
+)
+
+var log = jclog.New("control")
+
+// Messages waiting to be written to a client.  Clients that fall this far
+// behind are disconnected.
+const clientQueueSize = 256
+
+// HandlerFunc implements a method.  Return an *Error to choose the error
+// code, other errors are reported with CodeFailed.
+type HandlerFunc func(params json.RawMessage) (interface{}, error)
+
+type client struct {
+	conn  net.Conn
+	queue chan []byte
+	// nil until subscribed, empty for all events
+	events map[string]bool
+}
+
+// Server answers requests on a Unix-domain socket.
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	handlers map[string]HandlerFunc
+	clients  map[*client]struct{}
+}
+
+// Listen creates the socket at path.  The socket file gets the permission
+// bits in mode and, if group is not empty, belongs to that group, so that
+// its members can use it without being root.
+func Listen(path string, mode os.FileMode, group string) (*Server, error) {
+	if _, err := os.Lstat(path); err == nil {
+		// left over from a crash, unless the driver is still running
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("control: %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	// Only the owner may connect until the permissions are set.  The umask
+	// is process-wide, so restore it right away.
+	oldMask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, errors.Wrap(err, "control: listen")
+	}
+	err = setPermissions(path, mode, group)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &Server{
+		listener: l,
+		handlers: make(map[string]HandlerFunc),
+		clients:  make(map[*client]struct{}),
+	}, nil
+}
+
+func setPermissions(path string, mode os.FileMode, group string) error {
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return errors.Wrap(err, "control: socket group")
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return errors.Wrap(err, "control: socket group")
+		}
+		err = os.Chown(path, -1, gid)
+		if err != nil {
+			return errors.Wrap(err, "control: socket group")
+		}
+	}
+	return errors.Wrap(os.Chmod(path, mode), "control: socket permissions")
+}
+
+// Handle registers the implementation of a method.
+func (s *Server) Handle(method string, h HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[method] = h
+}
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		c := &client{
+			conn:  conn,
+			queue: make(chan []byte, clientQueueSize),
+		}
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		go s.writeLoop(c)
+		go s.readLoop(c)
+	}
+}
+
+// Close stops listening and removes the socket.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		s.removeClient(c)
+	}
+	return err
+}
+
+// Publish sends an event to the subscribed clients.  It does not block.
+func (s *Server) Publish(ev Event) {
+	msg, err := json.Marshal(Notification{JSONRPC: "2.0", Method: MethodEvent, Params: ev})
+	if err != nil {
+		log.Warnf("encoding event: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if c.events != nil && (len(c.events) == 0 || c.events[ev.Type]) {
+			s.sendTo(c, msg)
+		}
+	}
+}
+
+func (s *Server) writeLoop(c *client) {
+	for msg := range c.queue {
+		_, err := c.conn.Write(append(msg, '\n'))
+		if err != nil {
+			break
+		}
+	}
+	c.conn.Close()
+}
+
+func (s *Server) readLoop(c *client) {
+	defer func() {
+		s.mu.Lock()
+		s.removeClient(c)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			resp := s.handleRequest(c, line)
+			if resp != nil {
+				s.reply(c, resp)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleRequest returns the response, or nil for notifications.
+func (s *Server) handleRequest(c *client, line []byte) *Response {
+	var req Request
+	err := json.Unmarshal(line, &req)
+	if err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return errorResponse(nil, &Error{CodeParseError, err.Error()})
+		}
+		return errorResponse(nil, &Error{CodeInvalidRequest, err.Error()})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, &Error{CodeInvalidRequest, "not a JSON-RPC 2.0 request"})
+	}
+
+	var result interface{}
+	switch req.Method {
+	case MethodSubscribe:
+		var p SubscribeParams
+		err = DecodeParams(req.Params, &p)
+		if err == nil {
+			if p.Events == nil {
+				p.Events = []string{}
+			}
+			s.subscribe(c, p.Events)
+		}
+	case MethodUnsubscribe:
+		s.subscribe(c, nil)
+	default:
+		s.mu.Lock()
+		h, ok := s.handlers[req.Method]
+		s.mu.Unlock()
+		if !ok {
+			err = &Error{CodeMethodNotFound, "unknown method " + req.Method}
+			break
+		}
+		result, err = h(req.Params)
+	}
+
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return errorResponse(req.ID, err)
+	}
+	p, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, err)
+	}
+	return &Response{JSONRPC: "2.0", ID: req.ID, Result: p}
+}
+
+// subscribe sets the events sent to a client, nil for none.
+func (s *Server) subscribe(c *client, events []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if events == nil {
+		c.events = nil
+		return
+	}
+	c.events = make(map[string]bool)
+	for _, ev := range events {
+		c.events[ev] = true
+	}
+}
+
+func errorResponse(id *json.RawMessage, err error) *Response {
+	rpcErr, ok := err.(*Error)
+	if !ok {
+		rpcErr = &Error{CodeFailed, err.Error()}
+	}
+	return &Response{JSONRPC: "2.0", ID: id, Error: rpcErr}
+}
+
+// DecodeParams unmarshals the params of a request.  Missing params leave v
+// unchanged.
+func DecodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &Error{CodeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) reply(c *client, resp *Response) {
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		log.Warnf("encoding response: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendTo(c, msg)
+}
+
+// mu must be held
+func (s *Server) sendTo(c *client, msg []byte) {
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		// too slow, drop it
+		s.removeClient(c)
+	}
+}
+
+// mu must be held
+func (s *Server) removeClient(c *client) {
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.queue)
+	}
+}
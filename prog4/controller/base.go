@@ -1,14 +1,19 @@
 package controller
 
 import (
-	"fmt"
-
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
 )
 
+var log = jclog.New("controller")
+
 type base struct {
 	output jcpc.Output
 	ui     jcpc.Interface
+	// the controller embedding this struct
+	self jcpc.Controller
+
+	presses pressTracker
 
 	curState  jcpc.CombinedState
 	prevState jcpc.CombinedState
@@ -16,9 +21,38 @@ type base struct {
 
 func (c *base) BindToOutput(o jcpc.Output) {
 	c.output = o
+	if fo, ok := o.(jcpc.FeedbackOutput); ok {
+		fo.BindFeedback(c.self)
+	}
+}
+
+// TrackPresses sets the buttons that generate short / long / double press
+// virtual buttons.
+func (c *base) TrackPresses(buttons []jcpc.ButtonID) {
+	c.presses.setButtons(buttons)
 }
 
 func (c *base) OnFrame() {
+	events := c.presses.onFrame()
+	if len(events) == 0 || c.output == nil {
+		return
+	}
+	c.output.BeginUpdate()
+	c.sendVirtual(events)
+	err := c.output.FlushUpdate()
+	if err != nil {
+		log.Warnf("output error: %v", err)
+	}
+}
+
+// must be called between output.BeginUpdate() and output.FlushUpdate()
+func (c *base) sendVirtual(events []virtualEvent) {
+	for _, ev := range events {
+		c.output.ButtonUpdate(ev.b, ev.state)
+		if ev.state {
+			go c.ui.PressAction(c.self, ev.b)
+		}
+	}
 }
 
 func (c *base) Close() error {
@@ -38,6 +72,9 @@ func (c *base) dispatchUpdates() {
 			c.output.StickUpdate(jcpc.AxisID(i), c.curState.AdjSticks[i/2][i%2])
 		}
 	}
+	if buttonDiff != (jcpc.ButtonState{}) {
+		c.sendVirtual(c.presses.update(c.curState.Buttons))
+	}
 	if c.curState.Gyro != jcpc.GyroZero {
 		c.output.GyroUpdate(c.curState.Gyro[0])
 		c.output.GyroUpdate(c.curState.Gyro[1])
@@ -45,6 +82,6 @@ func (c *base) dispatchUpdates() {
 	}
 	err := c.output.FlushUpdate()
 	if err != nil {
-		fmt.Println("Output error:", err)
+		log.Warnf("output error: %v", err)
 	}
 }
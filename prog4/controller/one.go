@@ -16,24 +16,41 @@ type one struct {
 	lastUpdate time.Time
 
 	prevBattery int8
+	orientation jcpc.Orientation
 
 	stdTransitionDelay int8
 }
 
 func OneJoyCon(jc jcpc.JoyCon, ui jcpc.Interface) jcpc.Controller {
-	return &one{
+	c := &one{
 		jc: jc,
 		base: base{
 			ui: ui,
 		},
 		stdTransitionDelay: 3,
 	}
+	c.self = c
+	return c
 }
 
 func (c *one) Rumble(data []jcpc.RumbleData) {
 	c.jc.Rumble(data)
 }
 
+func (c *one) SetOrientation(o jcpc.Orientation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.orientation = o
+}
+
+func (c *one) Orientation() jcpc.Orientation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.orientation
+}
+
 func (c *one) JoyConUpdate(jc jcpc.JoyCon, flags int) {
 	if flags&jcpc.NotifyInput != 0 {
 		c.update()
@@ -53,6 +70,7 @@ func (c *one) update() {
 	c.prevState = c.curState
 	c.curState = jcpc.CombinedState{}
 	c.jc.ReadInto(&c.curState, true)
+	rotateState(c.jc.Type(), c.orientation, &c.curState)
 
 	c.dispatchUpdates()
 
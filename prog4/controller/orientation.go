@@ -0,0 +1,59 @@
+package controller
+
+import "github.com/riking/joycon/prog4/jcpc"
+
+// Face buttons going clockwise around the Joy-Con, starting from the one
+// that is on top when it is held upright.
+var (
+	faceButtonsL = [4]jcpc.ButtonID{jcpc.Button_L_Up, jcpc.Button_L_Right, jcpc.Button_L_Down, jcpc.Button_L_Left}
+	faceButtonsR = [4]jcpc.ButtonID{jcpc.Button_R_X, jcpc.Button_R_A, jcpc.Button_R_B, jcpc.Button_R_Y}
+)
+
+// rotateState turns the input from a single Joy-Con held in the given
+// orientation into the upright (OrientVertical) layout, which is what the
+// output mappings expect.
+func rotateState(side jcpc.JoyConType, o jcpc.Orientation, s *jcpc.CombinedState) {
+	// quarter turns between the held and the upright layout
+	var turns int
+	switch o {
+	case jcpc.OrientVertical:
+		return
+	case jcpc.OrientUpsideDown:
+		turns = 2
+	case jcpc.OrientSideways:
+		// The two Joy-Cons are turned opposite ways to hold them sideways.
+		if side.IsLeft() {
+			turns = 3
+		} else {
+			turns = 1
+		}
+	default:
+		return
+	}
+
+	stick := 1
+	face := faceButtonsR
+	if side.IsLeft() {
+		stick = 0
+		face = faceButtonsL
+	}
+
+	h, v := s.AdjSticks[stick][0], s.AdjSticks[stick][1]
+	switch turns {
+	case 1:
+		h, v = v, -h
+	case 2:
+		h, v = -h, -v
+	case 3:
+		h, v = -v, h
+	}
+	s.AdjSticks[stick][0], s.AdjSticks[stick][1] = h, v
+
+	var pressed [4]bool
+	for i, b := range face {
+		pressed[i] = s.Buttons.Get(b)
+	}
+	for i, b := range face {
+		s.Buttons = s.Buttons.Set(b, pressed[(i+4-turns)%4])
+	}
+}
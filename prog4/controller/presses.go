@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// Timing for virtual button generation, in frames (1/60 sec).
+const (
+	longPressFrames = 30
+	doubleTapFrames = 15
+)
+
+type pressState struct {
+	down      bool
+	downFrame int
+	upFrame   int
+	longSent  bool
+	// number of short presses waiting for the double-tap window to close
+	taps int
+}
+
+// pressTracker generates the PressShort, PressLong and PressDouble virtual
+// buttons for a set of physical buttons.
+//
+// Short and double presses are reported as a press followed by a release on
+// the next frame.  Long presses stay down until the physical button is
+// released.
+type pressTracker struct {
+	mu      sync.Mutex
+	frame   int
+	buttons map[jcpc.ButtonID]*pressState
+	// virtual buttons to release on the next frame
+	pulses []jcpc.ButtonID
+}
+
+type virtualEvent struct {
+	b     jcpc.ButtonID
+	state bool
+}
+
+func (t *pressTracker) setButtons(buttons []jcpc.ButtonID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buttons = make(map[jcpc.ButtonID]*pressState)
+	for _, b := range buttons {
+		t.buttons[b.Physical()] = &pressState{}
+	}
+}
+
+func (t *pressTracker) pulse(events []virtualEvent, b jcpc.ButtonID) []virtualEvent {
+	t.pulses = append(t.pulses, b)
+	return append(events, virtualEvent{b, true})
+}
+
+// update processes a change in physical button state.
+func (t *pressTracker) update(buttons jcpc.ButtonState) []virtualEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var events []virtualEvent
+	for b, st := range t.buttons {
+		down := buttons.Get(b)
+		if down == st.down {
+			continue
+		}
+		st.down = down
+		if down {
+			st.downFrame = t.frame
+			continue
+		}
+
+		// released
+		if st.longSent {
+			st.longSent = false
+			st.taps = 0
+			events = append(events, virtualEvent{b.Virtual(jcpc.PressLong), false})
+			continue
+		}
+		st.taps++
+		st.upFrame = t.frame
+		if st.taps >= 2 {
+			st.taps = 0
+			events = t.pulse(events, b.Virtual(jcpc.PressDouble))
+		}
+	}
+	return events
+}
+
+// onFrame advances the timers by one frame.
+func (t *pressTracker) onFrame() []virtualEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.frame++
+	var events []virtualEvent
+	for _, b := range t.pulses {
+		events = append(events, virtualEvent{b, false})
+	}
+	t.pulses = t.pulses[:0]
+
+	for b, st := range t.buttons {
+		if st.down && !st.longSent && t.frame-st.downFrame >= longPressFrames {
+			st.longSent = true
+			st.taps = 0
+			events = append(events, virtualEvent{b.Virtual(jcpc.PressLong), true})
+		}
+		if !st.down && st.taps > 0 && t.frame-st.upFrame > doubleTapFrames {
+			st.taps = 0
+			events = t.pulse(events, b.Virtual(jcpc.PressShort))
+		}
+	}
+	return events
+}
@@ -21,13 +21,15 @@ type pro struct {
 }
 
 func Pro(jc jcpc.JoyCon, ui jcpc.Interface) jcpc.Controller {
-	return &pro{
+	c := &pro{
 		jc: jc,
 		base: base{
 			ui: ui,
 		},
 		stdTransitionDelay: 3,
 	}
+	c.self = c
+	return c
 }
 
 func (c *pro) Rumble(data []jcpc.RumbleData) {
@@ -21,7 +21,7 @@ type two struct {
 }
 
 func TwoJoyCons(left, right jcpc.JoyCon, ui jcpc.Interface) jcpc.Controller {
-	return &two{
+	c := &two{
 		left:  left,
 		right: right,
 		base: base{
@@ -29,6 +29,8 @@ func TwoJoyCons(left, right jcpc.JoyCon, ui jcpc.Interface) jcpc.Controller {
 		},
 		stdTransitionDelay: 3,
 	}
+	c.self = c
+	return c
 }
 
 func (c *two) Rumble(data []jcpc.RumbleData) {
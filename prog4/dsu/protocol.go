@@ -0,0 +1,244 @@
+// Package dsu implements the server side of the DSU ("cemuhook") protocol,
+// which emulators such as Cemu, Dolphin, Citra and Yuzu use to read motion
+// controls over UDP.
+//
+// Every packet starts with a 16 byte header, followed by a 4 byte message
+// type and the message:
+//
+//	0  magic, "DSUS" from the server or "DSUC" from the client
+//	4  uint16 protocol version
+//	6  uint16 length of the packet after the header
+//	8  uint32 CRC32 of the whole packet, calculated with this field zeroed
+//	12 uint32 server or client ID
+//	16 uint32 message type
+//
+// All numbers are little-endian.
+package dsu
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+const (
+	protocolVersion = 1001
+	headerSize      = 16
+
+	msgVersion  = 0x100000
+	msgPortInfo = 0x100001
+	msgPadData  = 0x100002
+)
+
+const (
+	slotDisconnected = 0
+	slotConnected    = 2
+
+	modelFullGyro = 2
+
+	connectionBluetooth = 2
+
+	batteryNone     = 0x00
+	batteryCharging = 0xEE
+)
+
+// Pad data request flags.  A request with no flags subscribes to all slots.
+const (
+	registerSlot = 1 << iota
+	registerMAC
+)
+
+// Size of the message after the message type
+const (
+	infoSize    = 11
+	portInfoLen = infoSize + 1
+	padDataLen  = 80
+)
+
+// Joy-Con IMU scale at the default sensitivity.
+const (
+	accelPerG     = 4096
+	gyroDegPerSec = 4000.0 / 65535.0
+)
+
+type request struct {
+	clientID uint32
+	msgType  uint32
+	body     []byte
+}
+
+func parseRequest(p []byte) (request, error) {
+	var r request
+	if len(p) < headerSize+4 {
+		return r, errors.Errorf("short packet (%d bytes)", len(p))
+	}
+	if string(p[0:4]) != "DSUC" {
+		return r, errors.Errorf("bad magic %q", p[0:4])
+	}
+	if v := binary.LittleEndian.Uint16(p[4:]); v > protocolVersion {
+		return r, errors.Errorf("unsupported protocol version %d", v)
+	}
+	length := int(binary.LittleEndian.Uint16(p[6:]))
+	if headerSize+length > len(p) || length < 4 {
+		return r, errors.Errorf("bad length %d", length)
+	}
+	p = p[:headerSize+length]
+
+	crc := binary.LittleEndian.Uint32(p[8:])
+	check := make([]byte, len(p))
+	copy(check, p)
+	binary.LittleEndian.PutUint32(check[8:], 0)
+	if crc32.ChecksumIEEE(check) != crc {
+		return r, errors.Errorf("bad checksum")
+	}
+
+	r.clientID = binary.LittleEndian.Uint32(p[12:])
+	r.msgType = binary.LittleEndian.Uint32(p[16:])
+	r.body = p[headerSize+4:]
+	return r, nil
+}
+
+// newPacket allocates a server packet with the header and message type
+// filled in.  Call finishPacket once the message is written.
+func newPacket(serverID uint32, msgType uint32, msgLen int) []byte {
+	p := make([]byte, headerSize+4+msgLen)
+	copy(p, "DSUS")
+	binary.LittleEndian.PutUint16(p[4:], protocolVersion)
+	binary.LittleEndian.PutUint16(p[6:], uint16(len(p)-headerSize))
+	binary.LittleEndian.PutUint32(p[12:], serverID)
+	binary.LittleEndian.PutUint32(p[16:], msgType)
+	return p
+}
+
+func finishPacket(p []byte) []byte {
+	binary.LittleEndian.PutUint32(p[8:], 0)
+	binary.LittleEndian.PutUint32(p[8:], crc32.ChecksumIEEE(p))
+	return p
+}
+
+// slotInfo is the description of a slot that starts the port info and pad
+// data messages.
+type slotInfo struct {
+	slot      byte
+	connected bool
+	mac       [6]byte
+	battery   byte
+}
+
+func (s slotInfo) putInfo(p []byte) {
+	p[0] = s.slot
+	if s.connected {
+		p[1] = slotConnected
+		p[2] = modelFullGyro
+		p[3] = connectionBluetooth
+	} else {
+		p[1] = slotDisconnected
+	}
+	copy(p[4:10], s.mac[:])
+	p[10] = s.battery
+}
+
+// batteryLevel converts a level from JoyCon.Battery() to the DSU encoding.
+func batteryLevel(level int8, charging bool) byte {
+	if charging {
+		return batteryCharging
+	}
+	if level < 0 {
+		return batteryNone
+	}
+	// 0x01 (dying) to 0x05 (full)
+	return byte(level) + 1
+}
+
+// macFromSerial recovers the Bluetooth address from a Joy-Con serial
+// number, which is the address with or without separators.
+func macFromSerial(serial string) (mac [6]byte, ok bool) {
+	n := 0
+	for _, c := range serial {
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = byte(c - '0')
+		case c >= 'a' && c <= 'f':
+			v = byte(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			v = byte(c-'A') + 10
+		case c == ':' || c == '-':
+			continue
+		default:
+			return mac, false
+		}
+		if n >= 12 {
+			return mac, false
+		}
+		mac[n/2] |= v << uint(4*(1-n%2))
+		n++
+	}
+	return mac, n == 12
+}
+
+// Bits of the first and second button bytes.
+var padButtons = [2][8]jcpc.ButtonID{
+	{jcpc.Button_Minus, jcpc.Button_L_Stick, jcpc.Button_R_Stick, jcpc.Button_Plus,
+		jcpc.Button_L_Up, jcpc.Button_L_Right, jcpc.Button_L_Down, jcpc.Button_L_Left},
+	{jcpc.Button_L_ZL, jcpc.Button_R_ZR, jcpc.Button_L_L, jcpc.Button_R_R,
+		jcpc.Button_R_X, jcpc.Button_R_A, jcpc.Button_R_B, jcpc.Button_R_Y},
+}
+
+// Order of the analog button bytes.
+var padAnalogButtons = [12]jcpc.ButtonID{
+	jcpc.Button_L_Left, jcpc.Button_L_Down, jcpc.Button_L_Right, jcpc.Button_L_Up,
+	jcpc.Button_R_Y, jcpc.Button_R_B, jcpc.Button_R_A, jcpc.Button_R_X,
+	jcpc.Button_R_R, jcpc.Button_L_L, jcpc.Button_R_ZR, jcpc.Button_L_ZL,
+}
+
+func stickByte(v int16) byte {
+	return byte(128 + int(v)*127/0x7FF)
+}
+
+func putFloat(p []byte, f float64) {
+	binary.LittleEndian.PutUint32(p, math.Float32bits(float32(f)))
+}
+
+// putPadData writes the pad data message, which is everything after the
+// slot info.
+func putPadData(p []byte, packetNum uint32, st *jcpc.CombinedState, timestamp uint64) {
+	p[0] = 1 // connected
+	binary.LittleEndian.PutUint32(p[1:], packetNum)
+	for i, bits := range padButtons {
+		for j, b := range bits {
+			if st.Buttons.Get(b) {
+				p[5+i] |= 1 << uint(j)
+			}
+		}
+	}
+	if st.Buttons.Get(jcpc.Button_Home) {
+		p[7] = 1
+	}
+	if st.Buttons.Get(jcpc.Button_Capture) {
+		p[8] = 1
+	}
+	p[9] = stickByte(st.AdjSticks[0][0])
+	p[10] = stickByte(st.AdjSticks[0][1])
+	p[11] = stickByte(st.AdjSticks[1][0])
+	p[12] = stickByte(st.AdjSticks[1][1])
+	for i, b := range padAnalogButtons {
+		if st.Buttons.Get(b) {
+			p[13+i] = 0xFF
+		}
+	}
+	// 25..36 touch, unused
+	binary.LittleEndian.PutUint64(p[37:], timestamp)
+
+	// Latest of the three IMU frames in the report
+	imu := st.Gyro[2]
+	putFloat(p[45:], -float64(imu[1])/accelPerG)
+	putFloat(p[49:], float64(imu[2])/accelPerG)
+	putFloat(p[53:], float64(imu[0])/accelPerG)
+	putFloat(p[57:], -float64(imu[4])*gyroDegPerSec)
+	putFloat(p[61:], float64(imu[5])*gyroDegPerSec)
+	putFloat(p[65:], float64(imu[3])*gyroDegPerSec)
+}
@@ -0,0 +1,256 @@
+package dsu
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+var log = jclog.New("dsu")
+
+// DefaultAddress is the address emulators connect to unless configured
+// otherwise.
+const DefaultAddress = "127.0.0.1:26760"
+
+const numSlots = 4
+
+// Clients must repeat their pad data requests within this time.
+const subscriptionTimeout = 5 * time.Second
+
+type slot struct {
+	jcs []jcpc.JoyCon
+	// the JoyCon to take IMU data from
+	motion jcpc.JoyCon
+
+	state     jcpc.CombinedState
+	mac       [6]byte
+	packetNum uint32
+}
+
+type client struct {
+	addr *net.UDPAddr
+	// time of the last request for each slot
+	slots [numSlots]time.Time
+}
+
+// Server serves the state of paired controllers to DSU clients.  Slots are
+// numbered by player number, starting at 0.
+//
+// Server implements jcpc.Watcher and must be added to the Manager with
+// AddWatcher.
+type Server struct {
+	conn  *net.UDPConn
+	id    uint32
+	start time.Time
+
+	mu      sync.Mutex
+	slots   [numSlots]slot
+	clients map[string]*client
+}
+
+var _ jcpc.Watcher = (*Server)(nil)
+
+func NewServer(addr string) (*Server, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dsu: resolve address")
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dsu: listen")
+	}
+	return &Server{
+		conn:    conn,
+		id:      rand.Uint32(),
+		start:   time.Now(),
+		clients: make(map[string]*client),
+	}, nil
+}
+
+// Serve answers client requests until the server is closed.
+func (s *Server) Serve() {
+	var buf [1024]byte
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		req, err := parseRequest(buf[:n])
+		if err != nil {
+			log.Warnf("bad request from %v: %v", addr, err)
+			continue
+		}
+		s.handleRequest(addr, req)
+	}
+}
+
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Server) handleRequest(addr *net.UDPAddr, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.msgType {
+	case msgVersion:
+		p := newPacket(s.id, msgVersion, 2)
+		binary.LittleEndian.PutUint16(p[headerSize+4:], protocolVersion)
+		s.send(addr, p)
+	case msgPortInfo:
+		if len(req.body) < 4 {
+			return
+		}
+		count := int(binary.LittleEndian.Uint32(req.body))
+		if count > numSlots || count > len(req.body)-4 {
+			return
+		}
+		for _, idx := range req.body[4 : 4+count] {
+			if int(idx) >= numSlots {
+				continue
+			}
+			p := newPacket(s.id, msgPortInfo, portInfoLen)
+			s.slotInfo(int(idx)).putInfo(p[headerSize+4:])
+			s.send(addr, p)
+		}
+	case msgPadData:
+		if len(req.body) < 8 {
+			return
+		}
+		flags, slotNum := req.body[0], int(req.body[1])
+		var mac [6]byte
+		copy(mac[:], req.body[2:8])
+
+		c := s.clients[addr.String()]
+		if c == nil {
+			c = &client{addr: addr}
+			s.clients[addr.String()] = c
+		}
+		now := time.Now()
+		for i := range s.slots {
+			if flags == 0 ||
+				(flags&registerSlot != 0 && i == slotNum) ||
+				(flags&registerMAC != 0 && s.slots[i].jcs != nil && s.slots[i].mac == mac) {
+				c.slots[i] = now
+			}
+		}
+	}
+}
+
+// mu must be held
+func (s *Server) send(addr *net.UDPAddr, p []byte) {
+	_, err := s.conn.WriteToUDP(finishPacket(p), addr)
+	if err != nil {
+		log.Warnf("send to %v: %v", addr, err)
+	}
+}
+
+// mu must be held
+func (s *Server) slotInfo(idx int) slotInfo {
+	sl := &s.slots[idx]
+	info := slotInfo{
+		slot:      byte(idx),
+		connected: sl.jcs != nil,
+		mac:       sl.mac,
+	}
+	if sl.jcs != nil {
+		// Report the emptier battery of a pair
+		var level int8 = 4
+		var charging bool
+		for _, jc := range sl.jcs {
+			l, c := jc.Battery()
+			if l < level {
+				level = l
+			}
+			charging = charging || c
+		}
+		info.battery = batteryLevel(level, charging)
+	}
+	return info
+}
+
+func (s *Server) WatchController(pNum int, jcs []jcpc.JoyCon) {
+	idx := pNum - 1
+	if idx < 0 || idx >= numSlots {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.slots[idx] = slot{jcs: jcs}
+	if jcs == nil {
+		return
+	}
+	sl := &s.slots[idx]
+	sl.motion = jcs[0]
+	for _, jc := range jcs {
+		// Use the right Joy-Con of a pair, like the Switch does
+		if jc.Type().IsRight() {
+			sl.motion = jc
+		}
+	}
+	sl.motion.EnableGyro(true)
+	sl.mac, _ = macFromSerial(sl.motion.Serial())
+}
+
+func (s *Server) WatchUpdate(pNum int, jc jcpc.JoyCon, flags int) {
+	idx := pNum - 1
+	if idx < 0 || idx >= numSlots || flags&jcpc.NotifyInput == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sl := &s.slots[idx]
+	if sl.jcs == nil {
+		return
+	}
+	jc.ReadInto(&sl.state, jc == sl.motion)
+	if jc != sl.motion {
+		// wait for the motion data to send the packet
+		return
+	}
+
+	var p []byte
+	now := time.Now()
+	for key, c := range s.clients {
+		if now.Sub(c.slots[idx]) > subscriptionTimeout {
+			if c.expired(now) {
+				delete(s.clients, key)
+			}
+			continue
+		}
+		if p == nil {
+			sl.packetNum++
+			p = newPacket(s.id, msgPadData, padDataLen)
+			s.slotInfo(idx).putInfo(p[headerSize+4:])
+			putPadData(p[headerSize+4+infoSize:], sl.packetNum, &sl.state,
+				uint64(now.Sub(s.start)/time.Microsecond))
+			finishPacket(p)
+		}
+		_, err := s.conn.WriteToUDP(p, c.addr)
+		if err != nil {
+			log.Warnf("send to %v: %v", c.addr, err)
+		}
+	}
+}
+
+func (c *client) expired(now time.Time) bool {
+	for _, t := range c.slots {
+		if now.Sub(t) <= subscriptionTimeout {
+			return false
+		}
+	}
+	return true
+}
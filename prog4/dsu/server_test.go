@@ -0,0 +1,166 @@
+package dsu
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// fakeJoyCon is a right Joy-Con holding A with the sticks centered.
+type fakeJoyCon struct {
+	jcpc.JoyCon
+}
+
+func (fakeJoyCon) Serial() string         { return "98:B6:E9:01:02:03" }
+func (fakeJoyCon) Type() jcpc.JoyConType  { return jcpc.TypeRight }
+func (fakeJoyCon) Battery() (int8, bool)  { return 3, false }
+func (fakeJoyCon) EnableGyro(status bool) {}
+func (fakeJoyCon) ReadInto(out *jcpc.CombinedState, includeGyro bool) {
+	out.Buttons = out.Buttons.Set(jcpc.Button_R_A, true)
+	if includeGyro {
+		out.Gyro[2] = jcpc.GyroFrame{0, 0, accelPerG, 0, 0, 0}
+	}
+}
+
+func startServer(t *testing.T) (*Server, *net.UDPConn) {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.DialUDP("udp", nil, s.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+// sendRequest sends a client packet with a valid header and checksum.
+func sendRequest(t *testing.T, conn *net.UDPConn, msgType uint32, body []byte) {
+	p := make([]byte, headerSize+4+len(body))
+	copy(p, "DSUC")
+	binary.LittleEndian.PutUint16(p[4:], protocolVersion)
+	binary.LittleEndian.PutUint16(p[6:], uint16(len(p)-headerSize))
+	binary.LittleEndian.PutUint32(p[12:], 1234)
+	binary.LittleEndian.PutUint32(p[16:], msgType)
+	copy(p[headerSize+4:], body)
+	binary.LittleEndian.PutUint32(p[8:], crc32.ChecksumIEEE(p))
+	if _, err := conn.Write(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readReply reads a server packet, checks its header and checksum, and
+// returns the message after the message type.
+func readReply(t *testing.T, conn *net.UDPConn, s *Server, msgType uint32, size int) []byte {
+	var buf [1024]byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := buf[:n]
+	if n != size {
+		t.Fatalf("packet is %d bytes, want %d", n, size)
+	}
+	if string(p[0:4]) != "DSUS" {
+		t.Errorf("magic %q", p[0:4])
+	}
+	if v := binary.LittleEndian.Uint16(p[4:]); v != protocolVersion {
+		t.Errorf("version %d", v)
+	}
+	if l := binary.LittleEndian.Uint16(p[6:]); int(l) != n-headerSize {
+		t.Errorf("length %d, want %d", l, n-headerSize)
+	}
+	crc := binary.LittleEndian.Uint32(p[8:])
+	binary.LittleEndian.PutUint32(p[8:], 0)
+	if crc32.ChecksumIEEE(p) != crc {
+		t.Errorf("bad checksum %08x", crc)
+	}
+	if id := binary.LittleEndian.Uint32(p[12:]); id != s.id {
+		t.Errorf("server id %x, want %x", id, s.id)
+	}
+	if m := binary.LittleEndian.Uint32(p[16:]); m != msgType {
+		t.Errorf("message type %x, want %x", m, msgType)
+	}
+	return p[headerSize+4:]
+}
+
+func TestVersion(t *testing.T) {
+	s, conn := startServer(t)
+	sendRequest(t, conn, msgVersion, nil)
+	msg := readReply(t, conn, s, msgVersion, 22)
+	if v := binary.LittleEndian.Uint16(msg); v != protocolVersion {
+		t.Errorf("reported version %d", v)
+	}
+}
+
+func TestPortInfo(t *testing.T) {
+	s, conn := startServer(t)
+	s.WatchController(1, []jcpc.JoyCon{fakeJoyCon{}})
+
+	sendRequest(t, conn, msgPortInfo, []byte{2, 0, 0, 0, 0, 1})
+	msg := readReply(t, conn, s, msgPortInfo, 32)
+	want := []byte{0, slotConnected, modelFullGyro, connectionBluetooth,
+		0x98, 0xB6, 0xE9, 0x01, 0x02, 0x03, 4, 0}
+	if string(msg) != string(want) {
+		t.Errorf("slot 0: % x, want % x", msg, want)
+	}
+	msg = readReply(t, conn, s, msgPortInfo, 32)
+	if msg[0] != 1 || msg[1] != slotDisconnected {
+		t.Errorf("slot 1: % x", msg)
+	}
+}
+
+func TestPadData(t *testing.T) {
+	s, conn := startServer(t)
+	jc := fakeJoyCon{}
+	s.WatchController(1, []jcpc.JoyCon{jc})
+
+	// subscribe to all slots
+	sendRequest(t, conn, msgPadData, make([]byte, 8))
+	// the request is handled asynchronously
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := len(s.clients)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.WatchUpdate(1, jc, jcpc.NotifyInput)
+
+	msg := readReply(t, conn, s, msgPadData, 100)
+	if msg[0] != 0 || msg[1] != slotConnected {
+		t.Errorf("slot info % x", msg[:infoSize])
+	}
+	pad := msg[infoSize:]
+	if pad[0] != 1 {
+		t.Errorf("not connected")
+	}
+	if n := binary.LittleEndian.Uint32(pad[1:]); n != 1 {
+		t.Errorf("packet number %d", n)
+	}
+	if pad[6] != 1<<5 {
+		t.Errorf("buttons %08b, want A", pad[6])
+	}
+	for i := 9; i < 13; i++ {
+		if pad[i] != 128 {
+			t.Errorf("stick byte %d is %d, want 128", i, pad[i])
+		}
+	}
+	if pad[13+6] != 0xFF {
+		t.Errorf("analog A is %d", pad[13+6])
+	}
+	if f := binary.LittleEndian.Uint32(pad[49:]); f != 0x3F800000 {
+		t.Errorf("accel Y is %08x, want 1.0", f)
+	}
+}
@@ -0,0 +1,346 @@
+// Command jcctl manages a running jcdriver through its control socket.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/riking/joycon/prog4/control"
+)
+
+// Exit codes
+const (
+	exitOK = 0
+	// the driver reported an error
+	exitFailed = 1
+	exitUsage  = 2
+	// the driver could not be reached
+	exitConnection = 3
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *control.Client, argv []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"list", "list", cmdList},
+		{"pair", "pair u1 [u2]", cmdPair},
+		{"unpair", "unpair c1", cmdUnpair},
+		{"disconnect", "disconnect c1l", consoleCommand("disconnect", 1)},
+		{"lights", "lights c1 0x0F", cmdLights},
+		{"rumble", "rumble c1 [strong=40000] [weak=20000] [duration=500ms]", cmdRumble},
+		{"sync", "sync on|off", cmdSync},
+		{"spi", "spi read c1 0x6000 0x100 | spi write c1 0x8010 0xB2 0xA1 ...", cmdSPI},
+		{"calibrate", "calibrate c1l", consoleCommand("calibrate", 1)},
+		{"events", "events [--follow] [connected|disconnected|paired|unpaired|battery ...]", cmdEvents},
+		{"cmd", "cmd <console command> [args...]", cmdConsole},
+	}
+}
+
+var socketPath string
+var jsonOutput bool
+
+// usageError is printed with the usage of the command.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: jcctl [--socket path] [--json] <command> [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.StringVar(&socketPath, "socket", control.DefaultPath, "Path of the jcdriver control socket.")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the results as JSON.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "jcctl: unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	c, err := control.Dial(socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jcctl: could not connect to jcdriver: %v\n", err)
+		os.Exit(exitConnection)
+	}
+	defer c.Close()
+
+	err = cmd.run(c, flag.Args()[1:])
+	switch err := err.(type) {
+	case nil:
+		os.Exit(exitOK)
+	case usageError:
+		fmt.Fprintf(os.Stderr, "jcctl: %v\nusage: jcctl %s\n", err, cmd.usage)
+		os.Exit(exitUsage)
+	case *control.Error:
+		fmt.Fprintf(os.Stderr, "jcctl: %s\n", err.Message)
+		os.Exit(exitFailed)
+	default:
+		fmt.Fprintf(os.Stderr, "jcctl: lost connection to jcdriver: %v\n", err)
+		os.Exit(exitConnection)
+	}
+}
+
+// printJSON prints v in --json mode and reports whether it did.
+func printJSON(v interface{}) bool {
+	if !jsonOutput {
+		return false
+	}
+	json.NewEncoder(os.Stdout).Encode(v)
+	return true
+}
+
+func printJoyCon(indent string, jc control.JoyConInfo) {
+	charging := ""
+	if jc.Charging {
+		charging = ", charging"
+	}
+	fmt.Printf("%s%s: %s %s, battery %d/4%s\n", indent, jc.Name, jc.Type, jc.Serial, jc.Battery, charging)
+}
+
+func printController(c control.ControllerInfo) {
+	fmt.Printf("%s: player %d, %s\n", c.Name, c.Player, c.Type)
+	for _, jc := range c.JoyCons {
+		printJoyCon("  ", jc)
+	}
+}
+
+func cmdList(c *control.Client, argv []string) error {
+	var result control.ListResult
+	err := c.Call(control.MethodList, nil, &result)
+	if err != nil || printJSON(result) {
+		return err
+	}
+	if len(result.Unpaired) == 0 && len(result.Paired) == 0 {
+		fmt.Println("No JoyCons connected.")
+	}
+	for _, jc := range result.Unpaired {
+		printJoyCon("", jc)
+	}
+	for _, ctl := range result.Paired {
+		printController(ctl)
+	}
+	return nil
+}
+
+func cmdPair(c *control.Client, argv []string) error {
+	if len(argv) < 1 || len(argv) > 2 {
+		return usageError("specify one or two unpaired JoyCons")
+	}
+	var result control.ControllerInfo
+	err := c.Call(control.MethodPair, control.PairParams{JoyCons: argv}, &result)
+	if err != nil || printJSON(result) {
+		return err
+	}
+	printController(result)
+	return nil
+}
+
+func cmdUnpair(c *control.Client, argv []string) error {
+	if len(argv) != 1 {
+		return usageError("specify a controller")
+	}
+	var result control.ListResult
+	err := c.Call(control.MethodUnpair, control.ControllerParams{Controller: argv[0]}, &result)
+	if err != nil || printJSON(result) {
+		return err
+	}
+	for _, jc := range result.Unpaired {
+		printJoyCon("", jc)
+	}
+	return nil
+}
+
+func cmdLights(c *control.Client, argv []string) error {
+	if len(argv) != 2 {
+		return usageError("specify a JoyCon and a pattern")
+	}
+	pattern, err := strconv.ParseUint(argv[1], 0, 8)
+	if err != nil {
+		return usageError(fmt.Sprintf("invalid pattern %s", argv[1]))
+	}
+	return c.Call(control.MethodLights, control.LightsParams{JoyCon: argv[0], Pattern: byte(pattern)}, nil)
+}
+
+func cmdRumble(c *control.Client, argv []string) error {
+	if len(argv) < 1 || len(argv) > 4 {
+		return usageError("specify a JoyCon")
+	}
+	p := control.RumbleParams{JoyCon: argv[0], Strong: 40000, Weak: 20000, Duration: 500}
+	if len(argv) > 1 {
+		v, err := strconv.ParseUint(argv[1], 0, 16)
+		if err != nil {
+			return usageError(fmt.Sprintf("invalid strength %s", argv[1]))
+		}
+		p.Strong = uint16(v)
+	}
+	if len(argv) > 2 {
+		v, err := strconv.ParseUint(argv[2], 0, 16)
+		if err != nil {
+			return usageError(fmt.Sprintf("invalid strength %s", argv[2]))
+		}
+		p.Weak = uint16(v)
+	}
+	if len(argv) > 3 {
+		d, err := time.ParseDuration(argv[3])
+		if err != nil {
+			return usageError(fmt.Sprintf("invalid duration %s", argv[3]))
+		}
+		p.Duration = int(d / time.Millisecond)
+	}
+	return c.Call(control.MethodRumble, p, nil)
+}
+
+func cmdSync(c *control.Client, argv []string) error {
+	if len(argv) != 1 {
+		return usageError("specify on or off")
+	}
+	switch argv[0] {
+	case "on":
+		return c.Call(control.MethodStartSync, nil, nil)
+	case "off":
+		return c.Call(control.MethodStopSync, nil, nil)
+	}
+	return usageError("specify on or off")
+}
+
+func cmdSPI(c *control.Client, argv []string) error {
+	if len(argv) < 3 {
+		return usageError("specify read or write, a JoyCon and an address")
+	}
+	addr, err := strconv.ParseUint(argv[2], 0, 32)
+	if err != nil {
+		return usageError(fmt.Sprintf("invalid address %s", argv[2]))
+	}
+
+	switch argv[0] {
+	case "read":
+		if len(argv) != 4 {
+			return usageError("specify the size")
+		}
+		size, err := strconv.ParseUint(argv[3], 0, 32)
+		if err != nil {
+			return usageError(fmt.Sprintf("invalid size %s", argv[3]))
+		}
+		var result control.SPIReadResult
+		err = c.Call(control.MethodSPIRead, control.SPIReadParams{JoyCon: argv[1], Address: uint32(addr), Size: uint32(size)}, &result)
+		if err != nil || printJSON(result) {
+			return err
+		}
+		fmt.Print(hex.Dump(result.Data))
+		return nil
+	case "write":
+		if len(argv) < 4 {
+			return usageError("specify the data bytes")
+		}
+		data := make([]byte, len(argv)-3)
+		for i, s := range argv[3:] {
+			v, err := strconv.ParseUint(s, 0, 8)
+			if err != nil {
+				return usageError(fmt.Sprintf("invalid byte %s", s))
+			}
+			data[i] = byte(v)
+		}
+		return c.Call(control.MethodSPIWrite, control.SPIWriteParams{JoyCon: argv[1], Address: uint32(addr), Data: data}, nil)
+	}
+	return usageError("specify read or write")
+}
+
+func cmdEvents(c *control.Client, argv []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	follow := fs.Bool("follow", false, "Keep printing events instead of exiting after the first one.")
+	if err := fs.Parse(argv); err != nil {
+		return usageError(err.Error())
+	}
+
+	err := c.Subscribe(fs.Args()...)
+	if err != nil {
+		return err
+	}
+	for {
+		ev, err := c.NextEvent()
+		if err != nil {
+			return err
+		}
+		if !printJSON(ev) {
+			printEvent(ev)
+		}
+		if !*follow {
+			return nil
+		}
+	}
+}
+
+func printEvent(ev control.Event) {
+	switch {
+	case ev.JoyCon != nil:
+		fmt.Printf("%s ", ev.Type)
+		printJoyCon("", *ev.JoyCon)
+	case ev.Controller != nil:
+		fmt.Printf("%s ", ev.Type)
+		printController(*ev.Controller)
+	default:
+		fmt.Println(ev.Type)
+	}
+}
+
+// consoleCommand runs a console command that takes nargs arguments.
+func consoleCommand(name string, nargs int) func(c *control.Client, argv []string) error {
+	return func(c *control.Client, argv []string) error {
+		if len(argv) != nargs {
+			return usageError(fmt.Sprintf("expected %d arguments", nargs))
+		}
+		return runConsole(c, append([]string{name}, argv...))
+	}
+}
+
+func cmdConsole(c *control.Client, argv []string) error {
+	if len(argv) == 0 {
+		return usageError("specify a console command")
+	}
+	return runConsole(c, argv)
+}
+
+func runConsole(c *control.Client, args []string) error {
+	var result control.CommandResult
+	err := c.Call(control.MethodCommand, control.CommandParams{Args: args}, &result)
+	if err != nil || printJSON(result) {
+		return err
+	}
+	fmt.Print(result.Output)
+	if result.Output != "" && !strings.HasSuffix(result.Output, "\n") {
+		fmt.Println()
+	}
+	return nil
+}
@@ -1,8 +1,9 @@
-//+build !linux linux
+//+build !linux nobluez
 
 package main
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -31,7 +32,18 @@ type dummyBTManager struct {
 }
 
 func (m *dummyBTManager) SavePairingInfo(mac [6]byte) {}
-func (m *dummyBTManager) DeletePairingInfo()          {}
+
+func (m *dummyBTManager) DeletePairingInfo(mac string) ([]string, error) {
+	return nil, errors.New("remove the Joy-Cons in the system's Bluetooth settings instead")
+}
+
+func (m *dummyBTManager) SetAutoReconnect(enabled bool) error {
+	return errors.New("reconnecting is left to the system's Bluetooth stack")
+}
+
+func (m *dummyBTManager) AutoReconnect() bool { return false }
+
+func (m *dummyBTManager) UserDisconnected(mac string) {}
 
 // InitialScan emits an empty notification.
 func (m *dummyBTManager) InitialScan() {
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/riking/joycon/prog4/consoleiface"
+	"github.com/riking/joycon/prog4/control"
+	"github.com/riking/joycon/prog4/dsu"
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
+	"github.com/riking/joycon/prog4/remote"
+	"github.com/riking/joycon/prog4/webiface"
 )
 
+var log = jclog.New("main")
+
 //this is needed so we can have one flag multiple times, like --invert LV --invert LH
 type arrayFlags []string
 
@@ -24,49 +37,234 @@ func (i *arrayFlags) Set(value string) error {
 }
 
 var invertedAxes arrayFlags
+var execFiles arrayFlags
+var configFile string
+var analogTriggers, hatDPad, shiftLayers bool
+var dsuAddr string
+var webAddr string
+var outputNames string
+var remoteAddr, serveRemoteAddr, remoteKeyFile string
+var controlPath, controlMode, controlGroup string
+var stateFile string
+var verbose bool
+var logFile string
+var daemon bool
 
 func main() {
 	flag.Var(&invertedAxes, "invert", "Stick-Axes to invert. --invert LV inverts the vertical axis of the left stick. Can be specified multiple times.")
+	flag.BoolVar(&analogTriggers, "analog-triggers", false, "Report ZL/ZR as trigger axes instead of buttons.")
+	flag.BoolVar(&hatDPad, "hat-dpad", false, "Report the D-pad as a hat axis instead of buttons.")
+	flag.BoolVar(&shiftLayers, "shift-layers", false, "Use Capture and Home as shift buttons for alternate mappings.")
+	flag.StringVar(&dsuAddr, "dsu", "", "Serve motion controls to emulators over the DSU (cemuhook) protocol on this address, e.g. "+dsu.DefaultAddress+".")
+	flag.StringVar(&webAddr, "web", "", "Serve a WebSocket feed of controller state on this address, e.g. "+webiface.DefaultAddress+".")
+	flag.StringVar(&outputNames, "output", "", "Comma-separated list of outputs to send controller input to, e.g. uinput,console. Defaults to "+defaultOutputs+".")
+	flag.StringVar(&remoteAddr, "remote", "", "Send controller input to a jcdriver started with --serve-remote on this host:port.")
+	flag.StringVar(&serveRemoteAddr, "serve-remote", "", "Create devices for controllers connected to other computers with --remote, listening on this address, e.g. :7878.")
+	flag.StringVar(&remoteKeyFile, "remote-key-file", "", "File with a pre-shared key for --remote and --serve-remote.")
+	flag.Var(&execFiles, "exec", "File of console commands to run at startup. Can be specified multiple times.")
+	flag.StringVar(&configFile, "config", "", "JSON file with additional options, such as per-controller turbo and macro settings.")
+	flag.StringVar(&stateFile, "state", defaultStateFile(), "File where player numbers chosen at the console are remembered. Set to \"\" to not remember them.")
+	flag.StringVar(&controlPath, "control", control.DefaultPath, "Accept JSON-RPC requests, e.g. from jcctl, on a Unix socket at this path. Set to \"\" to turn off.")
+	flag.StringVar(&controlMode, "control-mode", "0660", "Permissions of the --control socket, in octal.")
+	flag.StringVar(&controlGroup, "control-group", "", "Group that owns the --control socket.")
+	flag.BoolVar(&verbose, "verbose", false, "Print debug messages, including hex dumps of the JoyCon traffic. Change it later with the loglevel command.")
+	flag.StringVar(&logFile, "log-file", "", "Also write all log messages to this file, one JSON object per line.")
+	flag.BoolVar(&daemon, "daemon", false, "Run as a service: no console, even on a terminal. SIGTERM stops the driver and SIGHUP reloads --config.")
 	flag.Parse()
 
+	if verbose {
+		jclog.SetLevel(jclog.All, jclog.LevelDebug)
+	}
+	if logFile != "" {
+		err := jclog.OpenJSONFile(logFile)
+		if err != nil {
+			log.Errorf("could not open log file: %v", err)
+			os.Exit(1)
+		}
+		defer jclog.Close()
+	}
+
 	// need 1 thread per blocked cgo call
 	runtime.GOMAXPROCS(8 + runtime.NumCPU())
 
-	of := getOutputFactory()
+	opts, err := OptionsFromFlags()
+	if err != nil {
+		log.Errorf("error when parsing flags: %v", err)
+		os.Exit(1)
+	}
+	remoteKey, err := loadRemoteKey(remoteKeyFile)
+	if err != nil {
+		log.Errorf("could not read remote key: %v", err)
+		os.Exit(1)
+	}
+	if serveRemoteAddr != "" {
+		runRemoteServer(serveRemoteAddr, opts, remoteKey)
+		return
+	}
+	if remoteAddr != "" {
+		remoteClient = remote.NewClient(remoteAddr, remoteKey)
+		go remoteClient.Run()
+		defer remoteClient.Close()
+	}
+
 	bt, err := getBluetoothManager()
 	if err != nil {
-		fmt.Println("[FATAL] Could not start up bluetooth manager:", err)
-		fmt.Println("You may need different compile options depending on your distribution")
+		log.Errorf("could not start up bluetooth manager: %v", err)
+		log.Infof("you may need different compile options depending on your distribution")
 		os.Exit(8)
 	}
 
-	opts, err := OptionsFromFlags()
+	of, err := getOutputFactory(opts.Outputs)
 	if err != nil {
-		fmt.Println("Error when parsing flags:", err.Error())
+		log.Errorf("could not set up outputs: %v", err)
 		os.Exit(1)
 	}
 	iface := consoleiface.New(of, bt, *opts)
+	if stateFile != "" {
+		err = iface.LoadState(stateFile)
+		if err != nil {
+			log.Warnf("could not load saved state: %v", err)
+		}
+	}
+	if dsuAddr != "" {
+		srv, err := dsu.NewServer(dsuAddr)
+		if err != nil {
+			log.Errorf("could not start DSU server: %v", err)
+			os.Exit(1)
+		}
+		go srv.Serve()
+		defer srv.Close()
+		iface.AddWatcher(srv)
+	}
+	if webAddr != "" {
+		srv, err := webiface.NewServer(webAddr, iface)
+		if err != nil {
+			log.Errorf("could not start WebSocket server: %v", err)
+			os.Exit(1)
+		}
+		go srv.Serve()
+		defer srv.Close()
+		iface.AddWatcher(srv)
+	}
+	if controlPath != "" {
+		mode, err := strconv.ParseUint(controlMode, 8, 32)
+		if err != nil {
+			log.Errorf("invalid --control-mode: %v", err)
+			os.Exit(1)
+		}
+		srv, err := control.Listen(controlPath, os.FileMode(mode), controlGroup)
+		if err != nil && flagWasSet("control") {
+			log.Errorf("could not start control socket: %v", err)
+			os.Exit(1)
+		} else if err != nil {
+			log.Warnf("control socket disabled, jcctl will not work: %v", err)
+		} else {
+			go srv.Serve()
+			defer srv.Close()
+			iface.ServeControl(srv)
+		}
+	}
+	if daemon {
+		iface.DisableConsole()
+	}
+	go handleSignals(iface)
+	go runScripts(iface, execFiles)
+	err = sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	if err != nil {
+		log.Warnf("could not notify the service manager: %v", err)
+	}
 	iface.Run()
 
 	defer func() {
-		fmt.Println("exiting...")
+		log.Infof("exiting...")
 		time.Sleep(2 * time.Second)
 	}()
 }
 
+// runScripts runs the --exec files in order.
+func runScripts(iface *consoleiface.Manager, paths []string) {
+	for _, path := range paths {
+		err := iface.RunScript(os.Stdout, path, nil)
+		if err != nil {
+			log.Warnf("script failed: %v", err)
+			return
+		}
+	}
+}
+
+// handleSignals stops the driver on SIGINT and SIGTERM, and reloads the
+// config file on SIGHUP.
+func handleSignals(iface *consoleiface.Manager) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Infof("received %v - shutting down", sig)
+			sdNotify("STOPPING=1")
+			iface.Stop()
+			continue
+		}
+		sdNotify("RELOADING=1")
+		opts, err := OptionsFromFlags()
+		if err != nil {
+			log.Warnf("could not reload configuration: %v", err)
+		} else {
+			iface.SetOptions(*opts)
+			log.Infof("reloaded configuration")
+		}
+		sdNotify("READY=1")
+	}
+}
+
+func defaultStateFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "jcdriver", "state.json")
+}
+
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // OptionsFormFlags parses the cli-flags into an Options-Struct
 func OptionsFromFlags() (*jcpc.Options, error) {
 	opts := jcpc.Options{}
 
-	stringToAxis := map[string]jcpc.AxisID{
-		"LV": jcpc.Axis_L_Vertical,
-		"LH": jcpc.Axis_L_Horiz,
-		"RV": jcpc.Axis_R_Vertical,
-		"RH": jcpc.Axis_R_Horiz,
+	if configFile != "" {
+		err := loadConfig(configFile, &opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if analogTriggers {
+		opts.InputRemapping.AnalogTriggers = true
+	}
+	if hatDPad {
+		opts.InputRemapping.HatDPad = true
+	}
+	if shiftLayers {
+		opts.InputRemapping.ShiftLayers = true
+	}
+
+	if outputNames != "" {
+		opts.Outputs = strings.Split(outputNames, ",")
+	} else if remoteAddr != "" {
+		opts.Outputs = []string{"remote"}
+	} else if opts.Outputs == nil {
+		opts.Outputs = strings.Split(defaultOutputs, ",")
 	}
 
 	for _, v := range invertedAxes {
-		if axisid, exists := stringToAxis[v]; exists {
+		if axisid, exists := jcpc.ParseAxis(v); exists {
 			opts.InputRemapping.InvertedAxes = append(opts.InputRemapping.InvertedAxes, axisid)
 		} else {
 			return nil, fmt.Errorf("Unknown Axis %s. Please input only values like (L/R)(V/H)", v)
@@ -75,3 +273,18 @@ func OptionsFromFlags() (*jcpc.Options, error) {
 
 	return &opts, nil
 }
+
+// loadConfig reads a JSON file into opts.
+func loadConfig(path string, opts *jcpc.Options) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(opts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+	"github.com/riking/joycon/prog4/output"
+)
+
+func consoleFactory(t jcpc.JoyConType, playerNum int, serials []string, remap jcpc.InputRemappingOptions) (jcpc.Output, error) {
+	return output.NewConsole(t, playerNum)
+}
+
+func availableOutputs() map[string]jcpc.OutputFactory {
+	result := map[string]jcpc.OutputFactory{
+		"console": consoleFactory,
+	}
+	for k, v := range platformOutputs {
+		result[k] = v
+	}
+	if remoteClient != nil {
+		result["remote"] = remoteClient.Factory()
+	}
+	return result
+}
+
+// getOutputFactory returns an OutputFactory that sends the controller input
+// to each of the named outputs.
+func getOutputFactory(names []string) (jcpc.OutputFactory, error) {
+	available := availableOutputs()
+	var factories []jcpc.OutputFactory
+	for _, name := range names {
+		f, ok := available[strings.TrimSpace(name)]
+		if !ok {
+			var known []string
+			for k := range available {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, errors.Errorf("Unknown output '%s', available outputs are: %s", name, strings.Join(known, ", "))
+		}
+		factories = append(factories, f)
+	}
+	if len(factories) == 0 {
+		return nil, errors.Errorf("No outputs selected")
+	}
+	return output.FanoutFactory(factories...), nil
+}
@@ -4,21 +4,41 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/riking/joycon/prog4/jcpc"
 	"github.com/riking/joycon/prog4/output"
 )
 
-func getOutputFactory() jcpc.OutputFactory {
-	return func(t jcpc.JoyConType, playerNum int, remap jcpc.InputRemappingOptions) (jcpc.Output, error) {
-		switch t {
-		case jcpc.TypeLeft:
-			return output.NewUInput(output.MappingL, fmt.Sprintf("Half Joy-Con %d", playerNum), remap)
-		case jcpc.TypeRight:
-			return output.NewUInput(output.MappingR, fmt.Sprintf("Half Joy-Con %d", playerNum), remap)
-		case jcpc.TypeBoth:
-			return output.NewUInput(output.MappingDual, fmt.Sprintf("Full Joy-Con %d", playerNum), remap)
-		}
-		panic("bad joycon type")
+const defaultOutputs = "uinput"
+
+var platformOutputs = map[string]jcpc.OutputFactory{
+	"uinput": uinputFactory,
+}
+
+func uinputFactory(t jcpc.JoyConType, playerNum int, serials []string, remap jcpc.InputRemappingOptions) (jcpc.Output, error) {
+	id := output.DeviceID{Uniq: strings.Join(serials, "+")}
+	var m output.ControllerMapping
+	var layers []output.ShiftLayer
+	var name string
+	switch t {
+	case jcpc.TypeLeft:
+		id.Product = jcpc.JOYCON_PRODUCT_FAKE_L
+		m, layers, name = output.MappingL, output.LayersL, "Half Joy-Con"
+	case jcpc.TypeRight:
+		id.Product = jcpc.JOYCON_PRODUCT_FAKE_R
+		m, layers, name = output.MappingR, output.LayersR, "Half Joy-Con"
+	case jcpc.TypePro:
+		id.Product = jcpc.JOYCON_PRODUCT_FAKE_PRO
+		m, layers, name = output.MappingDual, output.LayersDual, "Pro Controller"
+	case jcpc.TypeBoth:
+		id.Product = jcpc.JOYCON_PRODUCT_FAKE
+		m, layers, name = output.MappingDual, output.LayersDual, "Full Joy-Con"
+	default:
+		return nil, fmt.Errorf("bad joycon type %d", t)
+	}
+	if remap.ShiftLayers {
+		m.Layers = layers
 	}
+	return output.NewUInput(m, fmt.Sprintf("%s %d", name, playerNum), id, remap)
 }
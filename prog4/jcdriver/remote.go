@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/riking/joycon/prog4/jcpc"
+	"github.com/riking/joycon/prog4/remote"
+)
+
+// remoteClient is set when --remote is given, and provides the "remote"
+// output.
+var remoteClient *remote.Client
+
+// loadRemoteKey reads the pre-shared key for remote connections.  An empty
+// path means no key.
+func loadRemoteKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s: key file is empty", path)
+	}
+	return key, nil
+}
+
+// runRemoteServer creates devices for remote clients instead of using local
+// controllers.
+func runRemoteServer(addr string, opts *jcpc.Options, key []byte) {
+	of, err := getOutputFactory(opts.Outputs)
+	if err != nil {
+		log.Errorf("could not set up outputs: %v", err)
+		os.Exit(1)
+	}
+	srv, err := remote.NewServer(addr, of, key)
+	if err != nil {
+		log.Errorf("could not start remote server: %v", err)
+		os.Exit(1)
+	}
+	if key == nil {
+		log.Warnf("no --remote-key-file given, accepting clients without authentication")
+	}
+	log.Infof("waiting for remote controllers on %s", addr)
+
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt)
+		<-ch
+		srv.Close()
+	}()
+	srv.Serve()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify sends a state change such as "READY=1" to the service manager,
+// using the sd_notify protocol.  It does nothing if the driver was not
+// started by one, i.e. NOTIFY_SOCKET is not set.
+//
+// To try it without systemd, listen with "socat UNIX-RECVFROM:/tmp/n.sock,fork
+// STDOUT" and start jcdriver with NOTIFY_SOCKET=/tmp/n.sock.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		// abstract namespace
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// listenNotify listens on a unixgram socket and points NOTIFY_SOCKET at it.
+func listenNotify(t *testing.T, name, env string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", env)
+	return conn
+}
+
+func expectNotify(t *testing.T, conn *net.UnixConn, want string) {
+	var buf [256]byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn := listenNotify(t, path, path)
+
+	ready := fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())
+	for _, state := range []string{ready, "RELOADING=1", "READY=1", "STOPPING=1"} {
+		err := sdNotify(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNotify(t, conn, state)
+	}
+}
+
+func TestSdNotifyAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux only")
+	}
+	name := fmt.Sprintf("@jcdriver-test-%d", os.Getpid())
+	conn := listenNotify(t, name, name)
+
+	err := sdNotify("READY=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNotify(t, conn, "READY=1")
+}
+
+func TestSdNotifyUnset(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	err := sdNotify("READY=1")
+	if err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET: %v", err)
+	}
+}
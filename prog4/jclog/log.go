@@ -0,0 +1,248 @@
+// Package jclog is the driver's logger.  Every message has a level and a
+// component, and can carry fields such as the JoyCon serial number.
+// Messages are printed to the console, and can also be written to a file as
+// one JSON object per line.
+//
+// Each component has its own level, so that e.g. the bluez messages can be
+// turned up without drowning in everything else.
+package jclog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// LevelOff turns off all messages of a component.
+	LevelOff
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel looks up a level by name, ignoring case.
+func ParseLevel(name string) (Level, error) {
+	for i, v := range levelNames {
+		if strings.EqualFold(name, v) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level '%s', expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// All selects every component in SetLevel.
+const All = "all"
+
+var (
+	mu           sync.Mutex
+	defaultLevel           = LevelInfo
+	levels                 = make(map[string]Level)
+	components             = make(map[string]bool)
+	console      io.Writer = os.Stdout
+	jsonFile     io.WriteCloser
+)
+
+// SetLevel changes the level of a component, or of all components.
+func SetLevel(component string, level Level) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if component == All {
+		defaultLevel = level
+		levels = make(map[string]Level)
+		return nil
+	}
+	if !components[component] {
+		return errors.Errorf("unknown log component '%s', expected one of %s, %s", component, All, strings.Join(componentList(), ", "))
+	}
+	levels[component] = level
+	return nil
+}
+
+// GetLevel returns the level of a component.
+func GetLevel(component string) Level {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return levelOf(component)
+}
+
+// mu must be held
+func levelOf(component string) Level {
+	if l, ok := levels[component]; ok {
+		return l
+	}
+	return defaultLevel
+}
+
+// Components returns the names of the components that have a Logger.
+func Components() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return componentList()
+}
+
+// mu must be held
+func componentList() []string {
+	var result []string
+	for c := range components {
+		result = append(result, c)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SetConsole changes where messages are printed.  Pass nil to only write
+// the JSON file.
+func SetConsole(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	console = w
+}
+
+// OpenJSONFile appends all messages to a file, regardless of the console.
+func OpenJSONFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open log file")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if jsonFile != nil {
+		jsonFile.Close()
+	}
+	jsonFile = f
+	return nil
+}
+
+// Close closes the JSON file.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if jsonFile == nil {
+		return nil
+	}
+	err := jsonFile.Close()
+	jsonFile = nil
+	return err
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes the messages of one component.  The zero value is not
+// usable, use New.
+type Logger struct {
+	component string
+	fields    []field
+}
+
+// New returns the Logger of a component.
+func New(component string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	components[component] = true
+	return &Logger{component: component}
+}
+
+// With returns a Logger that adds a field to every message, such as the
+// serial number of a JoyCon.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{
+		component: l.component,
+		fields:    append(fields, field{key, value}),
+	}
+}
+
+// Enabled reports whether messages at this level are written anywhere.
+// Use it to skip building expensive debug output.
+func (l *Logger) Enabled(level Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return level >= levelOf(l.component) && (console != nil || jsonFile != nil)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args)
+}
+
+func (l *Logger) log(level Level, format string, args []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if level < levelOf(l.component) {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	now := time.Now()
+
+	if console != nil {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "[%s] %s: %s", strings.ToUpper(level.String()), l.component, msg)
+		for _, f := range l.fields {
+			fmt.Fprintf(&buf, " %s=%v", f.key, f.value)
+		}
+		buf.WriteByte('\n')
+		console.Write(buf.Bytes())
+	}
+
+	if jsonFile != nil {
+		entry := map[string]interface{}{
+			"time":      now.Format(time.RFC3339Nano),
+			"level":     level.String(),
+			"component": l.component,
+			"msg":       msg,
+		}
+		for _, f := range l.fields {
+			entry[f.key] = f.value
+		}
+		p, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		jsonFile.Write(append(p, '\n'))
+	}
+}
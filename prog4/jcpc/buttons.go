@@ -1,6 +1,9 @@
 package jcpc
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"strings"
+)
 
 type ButtonState [3]byte
 
@@ -120,9 +123,48 @@ const allButtonsRight0 = Button_R_Y | Button_R_X |
 	Button_R_R | Button_R_ZR
 const allButtonsRight1 = Button_Home | Button_Plus | Button_R_Stick
 
+// PressKind selects one of the virtual buttons generated from a physical
+// button by tracking how long and how often it is pressed.
+type PressKind int16
+
+const (
+	PressNormal PressKind = iota
+	// Pressed and released quickly, without a second press following.
+	PressShort
+	// Held down for a while.  Stays pressed until the button is released.
+	PressLong
+	// Pressed twice in quick succession.
+	PressDouble
+)
+
+const pressKindShift = 12
+
+// NumButtonIndexes is the number of distinct values returned by GetIndex(),
+// including virtual buttons.
+const NumButtonIndexes = int(PressDouble+1) * 3 * 8
+
+var pressKindNames = []string{"", "short", "long", "double"}
+
+// Virtual returns the virtual button for a short, long, or double press of a
+// physical button.
+func (b ButtonID) Virtual(k PressKind) ButtonID {
+	return b.Physical() | ButtonID(k)<<pressKindShift
+}
+
+// Physical returns the physical button that a virtual button is derived
+// from.
+func (b ButtonID) Physical() ButtonID {
+	return b & (1<<pressKindShift - 1)
+}
+
+func (b ButtonID) PressKind() PressKind {
+	return PressKind(b >> pressKindShift)
+}
+
 func (b ButtonID) GetIndex() int {
 	q := b & 0xFF
 	add := int((b & 0xF00) >> 5) // convert byte index to multiple of 8 - x >> 8 << 3
+	add += int(b.PressKind()) * len(ButtonList)
 	for i, v := range ButtonList {
 		if q == v {
 			return i + add
@@ -176,9 +218,40 @@ var buttonNameMap = map[ButtonID]string{
 }
 
 func (b ButtonID) String() string {
+	if k := b.PressKind(); k != PressNormal && int(k) < len(pressKindNames) {
+		return buttonNameMap[b.Physical()] + "." + pressKindNames[k]
+	}
 	return buttonNameMap[b]
 }
 
+// ParseButton looks up a ButtonID by its String() name, ignoring case.
+// "Minus" and "Plus" are accepted as alternate names for "-" and "+".
+//
+// Virtual buttons are named with a suffix, e.g. "Home.long".
+func ParseButton(name string) (ButtonID, bool) {
+	if idx := strings.LastIndex(name, "."); idx != -1 {
+		for k, kName := range pressKindNames {
+			if k != int(PressNormal) && strings.EqualFold(name[idx+1:], kName) {
+				b, ok := ParseButton(name[:idx])
+				return b.Virtual(PressKind(k)), ok
+			}
+		}
+		return 0, false
+	}
+	switch strings.ToLower(name) {
+	case "minus":
+		return Button_Minus, true
+	case "plus":
+		return Button_Plus, true
+	}
+	for b, bName := range buttonNameMap {
+		if strings.EqualFold(name, bName) {
+			return b, true
+		}
+	}
+	return 0, false
+}
+
 var axisNameMap = map[AxisID]string{
 	Axis_L_Vertical: "Up/Down",
 	Axis_L_Horiz:    "Left/Right",
@@ -192,6 +265,19 @@ var axisNameMap = map[AxisID]string{
 	Axis_Roll_Y:     "Roll Y",
 }
 
+var axisShortNames = map[string]AxisID{
+	"LH": Axis_L_Horiz,
+	"LV": Axis_L_Vertical,
+	"RH": Axis_R_Horiz,
+	"RV": Axis_R_Vertical,
+}
+
+// ParseAxis looks up a stick AxisID by its short name: LH, LV, RH or RV.
+func ParseAxis(name string) (AxisID, bool) {
+	a, ok := axisShortNames[strings.ToUpper(name)]
+	return a, ok
+}
+
 // ButtonsFromSlice copies the provided slice from a standard input report into
 // a ButtonState.
 func ButtonsFromSlice(b []byte) ButtonState {
@@ -326,7 +412,7 @@ func (b ButtonState) Remove(side JoyConType) ButtonState {
 		result[0] = b[0] &^ byte(allButtonsRight0&0xFF)
 		result[1] = b[1] &^ byte(allButtonsRight1&0xFF)
 		result[2] = b[2]
-	case TypeBoth:
+	case TypeBoth, TypePro:
 		result[0] = b[0] &^ byte(allButtonsRight0&0xFF)
 		result[1] = b[1] &^ byte((allButtonsRight1&0xFF)|(allButtonsLeft1&0xFF))
 		result[2] = b[2] &^ byte(allButtonsLeft2&0xFF)
@@ -1,6 +1,9 @@
 package jcpc
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+)
 
 func SetPlayerLights(jc JoyCon, pattern byte) {
 	command := []byte{0x30, byte(pattern)}
@@ -14,7 +17,21 @@ func SetHomeLightPulse(jc JoyCon, pulseData []byte) {
 
 const SPIMaxData = 0x1C
 
+// SPIFlashSize is the size of the SPI flash of Joy-Cons and Pro Controllers.
+const SPIFlashSize = 0x80000
+
+// CheckSPIRange returns an error if the range does not fit in the SPI flash.
+func CheckSPIRange(addr, size uint32) error {
+	if uint64(addr)+uint64(size) > SPIFlashSize {
+		return fmt.Errorf("range %06x+%x is past the end of the SPI flash (%06x)", addr, size, SPIFlashSize)
+	}
+	return nil
+}
+
 func SPIFlashRead(jc JoyCon, addr, size uint32) ([]byte, error) {
+	if err := CheckSPIRange(addr, size); err != nil {
+		return nil, err
+	}
 	if size > SPIMaxData {
 		return largeSPIRead(jc, addr, size)
 	}
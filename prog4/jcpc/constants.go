@@ -4,9 +4,14 @@ const (
 	VENDOR_NINTENDO           = 0x057e
 	JOYCON_PRODUCT_L          = 0x2006
 	JOYCON_PRODUCT_R          = 0x2007
-	JOYCON_PRODUCT_FAKE       = 0x2008 // TODO
 	JOYCON_PRODUCT_PRO        = 0x2009
 	JOYCON_PRODUCT_CHARGEGRIP = 0x200e
+
+	// Product IDs of the virtual devices, one per mapping layout
+	JOYCON_PRODUCT_FAKE     = 0x2008 // dual Joy-Cons
+	JOYCON_PRODUCT_FAKE_L   = 0x2106
+	JOYCON_PRODUCT_FAKE_R   = 0x2107
+	JOYCON_PRODUCT_FAKE_PRO = 0x2109
 )
 
 type JoyConType int
@@ -15,15 +20,22 @@ const (
 	TypeInvalid JoyConType = iota
 	TypeLeft
 	TypeRight
+	// Two Joy-Cons used together, or held by a charging grip
 	TypeBoth
+	TypePro
 )
 
 func (t JoyConType) IsLeft() bool {
-	return t == TypeLeft || t == TypeBoth
+	return t == TypeLeft || t == TypeBoth || t == TypePro
 }
 
 func (t JoyConType) IsRight() bool {
-	return t == TypeRight || t == TypeBoth
+	return t == TypeRight || t == TypeBoth || t == TypePro
+}
+
+// IsBoth reports whether a single device has the buttons of both sides.
+func (t JoyConType) IsBoth() bool {
+	return t == TypeBoth || t == TypePro
 }
 
 func (t JoyConType) String() string {
@@ -33,6 +45,8 @@ func (t JoyConType) String() string {
 	case TypeRight:
 		return "Joy-Con R"
 	case TypeBoth:
+		return "Charging Grip"
+	case TypePro:
 		return "Switch Pro Controller"
 	}
 	return "X"
@@ -3,6 +3,7 @@
 package jcpc
 
 import (
+	"fmt"
 	"image/color"
 )
 
@@ -30,9 +31,13 @@ type JoyCon interface {
 	ReadInto(out *CombinedState, includeGyro bool)
 
 	ChangeInputMode(mode InputMode) bool // returns false if impossible
+	InputMode() InputMode
 	EnableGyro(status bool)
 	SPIRead(addr uint32, len byte) ([]byte, error)
 	SPIWrite(addr uint32, p []byte) error
+	// Reads the stick calibration from SPI flash again, e.g. after it was
+	// changed on a Switch.
+	ReloadCalibration() error
 
 	// Valid returns have alpha=255. If alpha=0 the value is not yet available.
 	CaseColor() color.RGBA
@@ -53,6 +58,10 @@ type Controller interface {
 	// forwards to each JoyCon
 	Rumble(d []RumbleData)
 
+	// Report short, long and double presses of these buttons as virtual
+	// buttons, see ButtonID.Virtual().
+	TrackPresses(buttons []ButtonID)
+
 	OnFrame()
 
 	Close() error
@@ -60,6 +69,7 @@ type Controller interface {
 
 // Output represents an OS-level event sink for a Controller object.
 // The Controller should call BeginUpdate(), then several *Update() methods, followed by FlushUpdate().
+// FlushUpdate() must be called even if BeginUpdate() returned an error.
 type Output interface {
 	BeginUpdate() error
 	ButtonUpdate(b ButtonID, value bool)
@@ -71,11 +81,51 @@ type Output interface {
 	Close() error
 }
 
-type OutputFactory func(t JoyConType, playerNum int, remap InputRemappingOptions) (Output, error)
+// FeedbackOutput is implemented by Outputs that can send force feedback
+// back to the controller.
+type FeedbackOutput interface {
+	BindFeedback(r Rumbler)
+}
+
+// Rumbler receives force feedback from an Output.  Controller implements
+// Rumbler.
+type Rumbler interface {
+	Rumble(d []RumbleData)
+}
+
+// LightsOutput is implemented by Outputs that let the host set the player
+// lights.
+type LightsOutput interface {
+	BindLights(l LightSetter)
+}
+
+// LightSetter receives player lights set by the host, as a SetPlayerLights
+// pattern.  A pattern of 0 means that the host turned all lights off and no
+// longer controls them.  SetLights is called from Output.OnFrame.
+type LightSetter interface {
+	SetLights(pattern byte)
+}
+
+// OutputFactory creates the Output for a controller.  serials are the serial
+// numbers of the controller's JoyCons, left first.
+type OutputFactory func(t JoyConType, playerNum int, serials []string, remap InputRemappingOptions) (Output, error)
 
 type Interface interface {
 	JoyConNotify
 	RemoveController(c Controller)
+	// Called when a controller presses a virtual button.
+	PressAction(c Controller, b ButtonID)
+}
+
+// Watcher receives the input of paired controllers alongside their Output,
+// for example to serve it over the network.  Methods are called with the
+// Interface locked and must not block.
+type Watcher interface {
+	// Called when a controller is paired, or with jcs=nil when it is
+	// removed.
+	WatchController(pNum int, jcs []JoyCon)
+	// Called for every JoyConUpdate of a JoyCon in a paired controller.
+	WatchUpdate(pNum int, jc JoyCon, flags int)
 }
 
 // BluetoothManager provides an interface to the OS bluetooth stack.
@@ -97,8 +147,20 @@ type BluetoothManager interface {
 	SavePairingInfo(mac [6]byte)
 	// The UI code must provide a way for the user to reset auto-reconnect
 	// records, which (Linux) will occur whenever the Joy-Con is connected to a
-	// different Switch.
-	DeletePairingInfo()
+	// different Switch.  If mac is not empty, only the record of that device
+	// is removed.  Returns the MAC addresses of the removed records, and an
+	// error if any could not be removed.
+	DeletePairingInfo(mac string) ([]string, error)
+
+	// SetAutoReconnect turns on or off connecting to known controllers that
+	// are not connected, in the background.  On by default where supported.
+	SetAutoReconnect(enabled bool) error
+	AutoReconnect() bool
+	// UserDisconnected is called when the user disconnects the controller
+	// with this MAC address (its Serial()).  It is not reconnected
+	// automatically until it connects by itself, e.g. after a button press
+	// or sync.
+	UserDisconnected(mac string)
 
 	NotifyChannel() <-chan BluetoothDeviceNotification
 }
@@ -163,13 +225,134 @@ func (i InputMode) NeedsEmptyRumbles() bool {
 	return i == InputActivePolling
 }
 
+var inputModeNames = map[InputMode]string{
+	InputIRPolling:        "IR polling",
+	InputIRPollingUnused:  "IR polling (unused)",
+	InputIRPollingSpecial: "IR polling (special)",
+	InputMCUUpdate:        "MCU update",
+	InputStandard:         "standard",
+	InputNFC:              "NFC/IR",
+	InputUnknown33:        "unknown 0x33",
+	InputUnknown35:        "unknown 0x35",
+	InputLazyButtons:      "simple HID",
+	InputActivePolling:    "active polling",
+}
+
+func (i InputMode) String() string {
+	if name, ok := inputModeNames[i]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", int(i))
+}
+
 //Options specifies Options for changing the programms behavior (for example obtained via cli-flags)
 type Options struct {
 	InputRemapping InputRemappingOptions
+
+	// Names of the outputs each controller is sent to, e.g. "uinput" and
+	// "console".
+	Outputs []string
+
+	// Controllers holds per-controller settings, keyed by the serial number
+	// of one of the controller's Joy-Cons.  The "default" entry is used for
+	// controllers that do not have their own entry.
+	Controllers map[string]ControllerOptions
+
+	Presses PressOptions
+
+	// Event type (connected, disconnected, paired, unpaired, battery) ->
+	// file of console commands to run when it happens.  The scripts can use
+	// $name, $type, $serial, $player, $battery and $charging.
+	Scripts map[string]string
+
+	// Shell commands to run on events
+	Hooks []HookOptions
+
+	// How a Joy-Con warns that its battery is low (level 1) and almost
+	// empty (level 0)
+	LowBattery      BatteryAlertOptions
+	CriticalBattery BatteryAlertOptions
+}
+
+// BatteryAlertOptions configures a low battery alert.  It repeats until the
+// Joy-Con is charging.
+type BatteryAlertOptions struct {
+	// Any of "rumble", "lights" (blink the player lights) and "home" (pulse
+	// the Home LED).  Unset uses the default, an empty list turns the alert
+	// off.
+	Alerts []string
+	// Time between alerts, e.g. "5m"
+	Interval string
+}
+
+// HookOptions configures a shell command that is run on an event.  The
+// details of the event are passed in the environment variables JC_EVENT,
+// JC_NAME, JC_TYPE, JC_SERIAL, JC_PLAYER, JC_BATTERY, JC_CHARGING and, for
+// chords, JC_BUTTONS, where they apply.
+type HookOptions struct {
+	// connected, disconnected, paired, unpaired, low-battery or chord
+	Event string
+	// For chord hooks: the buttons that have to be held together on a
+	// paired controller, e.g. ["Plus", "Minus"]
+	Buttons []string
+	// Run with sh -c
+	Command string
+	// Time after which the command is killed, e.g. "10s".  Defaults to 30s.
+	Timeout string
+	// How many copies of the command may run at once.  Events that arrive
+	// while that many are running are dropped.  Defaults to 1.
+	MaxRunning int
+}
+
+// ControllerOptions configures the turbo / toggle / macro layer of a
+// controller.  Buttons are named as in ButtonID.String().
+type ControllerOptions struct {
+	// Button name -> presses per second
+	Turbo map[string]int
+	// Buttons that latch on the first press and release on the second
+	Toggle []string
+	// Trigger button name -> macro, see output.ParseMacro for the syntax
+	Macros map[string]string
+
+	// Override InputRemappingOptions.AnalogTriggers / HatDPad /
+	// ShiftLayers for this controller.  nil uses the global setting.
+	AnalogTriggers *bool
+	HatDPad        *bool
+	ShiftLayers    *bool
+
+	// How a single Joy-Con is held, see ParseOrientation.  Defaults to
+	// "sideways".
+	Orientation string
+}
+
+// PressOptions configures the short / long / double press virtual buttons.
+type PressOptions struct {
+	// Buttons that generate virtual buttons.  Defaults to Home and Capture.
+	Buttons []string
+	// Virtual button name (e.g. "Home.long") -> console command to run
+	Actions map[string]string
+}
+
+// ForController returns the ControllerOptions for a controller made from
+// Joy-Cons with the given serial numbers.
+func (o *Options) ForController(serials ...string) ControllerOptions {
+	for _, s := range serials {
+		if co, ok := o.Controllers[s]; ok {
+			return co
+		}
+	}
+	return o.Controllers["default"]
 }
 
 //InputRemappingOptions specifies if and how Buttons or Axes should be remapped
-//currently only Axis-Inversion is implemented
+//and which event types the output device uses
 type InputRemappingOptions struct {
 	InvertedAxes []AxisID
+
+	// Report ZL/ZR as trigger axes (ABS_Z / ABS_RZ) instead of buttons
+	AnalogTriggers bool
+	// Report the D-pad as a hat (ABS_HAT0X / ABS_HAT0Y) instead of buttons
+	HatDPad bool
+	// Use Capture / Home as shift buttons for alternate mappings
+	ShiftLayers bool
 }
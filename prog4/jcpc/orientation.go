@@ -0,0 +1,46 @@
+package jcpc
+
+import "strings"
+
+// Orientation is the way a single Joy-Con is held.
+type Orientation int
+
+const (
+	// Held horizontally with the shoulder buttons (SL/SR) facing away.
+	OrientSideways Orientation = iota
+	// Held upright, the way it is attached to a Switch.
+	OrientVertical
+	// Held upright, but rotated 180 degrees.
+	OrientUpsideDown
+)
+
+var orientationNames = []string{
+	OrientSideways:   "sideways",
+	OrientVertical:   "vertical",
+	OrientUpsideDown: "upside-down",
+}
+
+func (o Orientation) String() string {
+	if int(o) < 0 || int(o) >= len(orientationNames) {
+		return "unknown"
+	}
+	return orientationNames[o]
+}
+
+// ParseOrientation looks up an Orientation by its String() name.
+func ParseOrientation(name string) (Orientation, bool) {
+	for i, v := range orientationNames {
+		if strings.EqualFold(name, v) {
+			return Orientation(i), true
+		}
+	}
+	return 0, false
+}
+
+// OrientableController is implemented by controllers that can rotate their
+// input to match how they are held.
+type OrientableController interface {
+	Controller
+	SetOrientation(o Orientation)
+	Orientation() Orientation
+}
@@ -1,5 +1,7 @@
 package jcpc
 
+import "math"
+
 type RumbleData struct {
 	Data [8]byte
 	// number of frames that Data remains the same
@@ -11,3 +13,57 @@ var RumbleDataNeutral = RumbleData{[8]byte{0, 1, 0x40, 0x40, 0, 1, 0x40, 0x40},
 type GyroFrame [6]int16
 
 var GyroZero [3]GyroFrame
+
+// Frequencies used by RumbleFromMagnitude, in Hz.
+const (
+	rumbleFreqLow  = 160
+	rumbleFreqHigh = 320
+)
+
+// RumbleFromMagnitude encodes a "dual motor" style rumble, as used by
+// gamepad force feedback, for both sides of the controller.  The strong
+// magnitude drives the low frequency and the weak one the high frequency.
+func RumbleFromMagnitude(strong, weak uint16, frames int) RumbleData {
+	hf := uint16((encodeRumbleFreq(rumbleFreqHigh) - 0x60) * 4)
+	lf := byte(encodeRumbleFreq(rumbleFreqLow) - 0x40)
+	hfAmp := uint16(encodeRumbleAmp(float64(weak)/0xFFFF)) * 2
+	lfAmp := uint16(encodeRumbleAmp(float64(strong)/0xFFFF))/2 + 0x40
+
+	var side [4]byte
+	side[0] = byte(hf & 0xFF)
+	side[1] = byte(hfAmp) + byte(hf>>8)
+	side[2] = lf + byte(lfAmp>>8)
+	side[3] = byte(lfAmp & 0xFF)
+
+	var r RumbleData
+	copy(r.Data[0:4], side[:])
+	copy(r.Data[4:8], side[:])
+	r.Time = frames
+	return r
+}
+
+func encodeRumbleFreq(hz float64) int {
+	return int(math.Floor(math.Log2(hz/10)*32 + 0.5))
+}
+
+// amp is from 0 to 1.  Approximates the amplitude table from the
+// reverse-engineering notes.
+func encodeRumbleAmp(amp float64) byte {
+	var v float64
+	switch {
+	case amp <= 0:
+		return 0
+	case amp > 0.23:
+		v = math.Log2(amp*8.7) * 32
+	default:
+		v = math.Log2(amp*17) * 16
+	}
+	v = math.Floor(v + 0.5)
+	if v < 1 {
+		return 1
+	}
+	if v > 100 {
+		return 100
+	}
+	return byte(v)
+}
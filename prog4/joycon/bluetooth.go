@@ -11,14 +11,18 @@ import (
 
 	"github.com/GeertJohan/go.hid"
 	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
 )
 
+var log = jclog.New("joycon")
+
 type joyconBluetooth struct {
 	hidHandle *hid.Device
 
 	serial string
 	side   jcpc.JoyConType
+	log    *jclog.Logger
 
 	mu sync.Mutex
 
@@ -62,6 +66,7 @@ func NewBluetooth(hidHandle *hid.Device, side jcpc.JoyConType, ui jcpc.Interface
 	if err != nil {
 		return nil, err
 	}
+	jc.log = log.With("serial", jc.serial)
 	jc.side = side
 	jc.controller = nil
 	jc.haveColors = false
@@ -74,18 +79,28 @@ func NewBluetooth(hidHandle *hid.Device, side jcpc.JoyConType, ui jcpc.Interface
 	// TODO cache this data
 	go func() {
 		time.Sleep(100 * time.Millisecond)
-		_, err := jc.SPIRead(factoryStickCalibStart, factoryStickCalibLen)
-		if err != nil {
-			fmt.Println("Error:", err)
-		}
-		_, err = jc.SPIRead(userStickCalibStart, userStickCalibLen)
+		err := jc.ReloadCalibration()
 		if err != nil {
-			fmt.Println("Error:", err)
+			jc.log.Warnf("%v", err)
 		}
 	}()
 	return jc, nil
 }
 
+// ReloadCalibration reads the factory and user stick calibration from SPI
+// flash.  The replies are parsed by handleSPIRead.
+func (jc *joyconBluetooth) ReloadCalibration() error {
+	_, err := jc.SPIRead(factoryStickCalibStart, factoryStickCalibLen)
+	if err != nil {
+		return errors.Wrap(err, "reading factory calibration")
+	}
+	_, err = jc.SPIRead(userStickCalibStart, userStickCalibLen)
+	if err != nil {
+		return errors.Wrap(err, "reading user calibration")
+	}
+	return nil
+}
+
 func (jc *joyconBluetooth) Serial() string {
 	return jc.serial
 }
@@ -144,6 +159,13 @@ func (jc *joyconBluetooth) ChangeInputMode(newMode jcpc.InputMode) bool {
 	return true
 }
 
+func (jc *joyconBluetooth) InputMode() jcpc.InputMode {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+
+	return jc.mode
+}
+
 func (jc *joyconBluetooth) ReadInto(out *jcpc.CombinedState, includeGyro bool) {
 	jc.mu.Lock()
 	defer jc.mu.Unlock()
@@ -285,7 +307,7 @@ func (jc *joyconBluetooth) Reconnect(hidDeviceInfo interface{}) {
 
 	handle, err := dev.Device()
 	if err != nil {
-		fmt.Println("[ ERR] Could not open JoyCon device", err)
+		jc.log.Errorf("could not open JoyCon device: %v", err)
 		return
 	}
 
@@ -409,7 +431,7 @@ func (jc *joyconBluetooth) onReadError(err error) {
 	jc.hidHandle = nil
 	jc.mu.Unlock()
 
-	fmt.Printf("[ ERR] JoyCon %s read error: %v\n", jc.serial, err)
+	jc.log.Errorf("read error: %v", err)
 
 	go notify(jc, jcpc.NotifyConnection, jc.ui, jc.controller)
 }
@@ -442,7 +464,7 @@ func (jc *joyconBluetooth) handleButtonPush(packet []byte) {
 	if jc.mode != jcpc.InputLazyButtons {
 		return
 	}
-	if jc.side == jcpc.TypeBoth {
+	if jc.side.IsBoth() {
 		// TODO: support Pro Controller
 		jc.queueSubcommand([]byte{0})
 		return
@@ -461,8 +483,8 @@ func gyroDiff(prevFrame, curFrame [6]int16) [6]int16 {
 	return result
 }
 
-func gyroPrint(frame [6]int16) {
-	fmt.Printf("  %7d %7d %7d %7d %7d %7d\n", frame[0], frame[1], frame[2], frame[3], frame[4], frame[5])
+func gyroFormat(frame [6]int16) string {
+	return fmt.Sprintf("  %7d %7d %7d %7d %7d %7d\n", frame[0], frame[1], frame[2], frame[3], frame[4], frame[5])
 }
 
 func (jc *joyconBluetooth) fillGyroData(packet []byte) {
@@ -483,13 +505,16 @@ func (jc *joyconBluetooth) fillGyroData(packet []byte) {
 		}
 	}
 
-	fmt.Print("Gyro data:\n")
-	gyroPrint(gyroDiff(prevFrame, jc.gyro[0]))
-	gyroPrint(jc.gyro[0])
-	gyroPrint(gyroDiff(jc.gyro[0], jc.gyro[1]))
-	gyroPrint(jc.gyro[1])
-	gyroPrint(gyroDiff(jc.gyro[1], jc.gyro[2]))
-	gyroPrint(jc.gyro[2])
+	// 60 times a second, so only at debug level
+	if jc.log.Enabled(jclog.LevelDebug) {
+		jc.log.Debugf("gyro data:\n%s%s%s%s%s%s",
+			gyroFormat(gyroDiff(prevFrame, jc.gyro[0])),
+			gyroFormat(jc.gyro[0]),
+			gyroFormat(gyroDiff(jc.gyro[0], jc.gyro[1])),
+			gyroFormat(jc.gyro[1]),
+			gyroFormat(gyroDiff(jc.gyro[1], jc.gyro[2])),
+			gyroFormat(jc.gyro[2]))
+	}
 }
 
 func (jc *joyconBluetooth) handleSubcommandReply(_packet []byte) {
@@ -512,8 +537,8 @@ func (jc *joyconBluetooth) handleSubcommandReply(_packet []byte) {
 	case 0x01: // Manual Pairing
 		unknown = true
 	case 0x02: // Device Info
-		fmt.Printf("%s: Firmware %d.%d, type %d, MAC %02X:%02X:%02X:%02X:%02X:%02X, colors_on %d\n",
-			jc.serial, int(packet[0]), int(packet[1]),
+		jc.log.Infof("firmware %d.%d, type %d, MAC %02X:%02X:%02X:%02X:%02X:%02X, colors_on %d",
+			int(packet[0]), int(packet[1]),
 			packet[2], /* packet[3], */
 			packet[4], packet[5], packet[6], packet[7], packet[8], packet[9],
 			/* packet[10], */
@@ -536,7 +561,7 @@ func (jc *joyconBluetooth) handleSubcommandReply(_packet []byte) {
 	}
 
 	if unknown {
-		fmt.Printf("got subcommand reply packet: %d\n%s", replyPacketID, hex.Dump(packet[12:]))
+		jc.log.Debugf("got subcommand reply packet: %d\n%s", replyPacketID, hex.Dump(packet[12:]))
 	}
 }
 
@@ -585,8 +610,7 @@ func (jc *joyconBluetooth) reader() {
 			jc.handleButtonPush(packet)
 			notify(jc, jcpc.NotifyInput, jc.ui, jc.controller)
 		default:
-			fmt.Println("[!!] Unknown INPUT packet type ", packet[0])
-			fmt.Printf("Packet %02X:\n%s", packet[0], hex.Dump(packet[1:]))
+			jc.log.Debugf("unknown input packet type %02X:\n%s", packet[0], hex.Dump(packet[1:]))
 		}
 	}
 }
@@ -623,12 +647,10 @@ func (jc *joyconBluetooth) handleSPIRead(packet []byte) {
 		jc.buttonColor.A = 255
 		jc.mu.Unlock()
 
-		if true {
-			fmt.Printf("%s: Got factory calibration and button colors\n", jc.serial)
-		}
-		fmt.Printf("%s: SPI read returned [%x+%d]\n%s", jc.serial, addr, length, hex.Dump(data))
+		jc.log.Infof("got factory calibration and button colors")
+		jc.log.Debugf("SPI read returned [%x+%d]\n%s", addr, length, hex.Dump(data))
 	} else if addr == userStickCalibStart && length == userStickCalibLen {
-		fmt.Printf("%s: SPI read returned [%x+%d]\n%s", jc.serial, addr, length, hex.Dump(data))
+		jc.log.Debugf("SPI read returned [%x+%d]\n%s", addr, length, hex.Dump(data))
 		had := false
 		jc.mu.Lock()
 		const magicHaveCalibration = 0xA1B2
@@ -643,12 +665,12 @@ func (jc *joyconBluetooth) handleSPIRead(packet []byte) {
 		jc.mu.Unlock()
 
 		if had {
-			fmt.Printf("%s: Read user stick calibration: %v\n", jc.serial, jc.calib)
+			jc.log.Infof("read user stick calibration: %v", jc.calib)
 		} else {
-			fmt.Printf("%s: Checked user stick calibration: %v\n", jc.serial, jc.calib)
+			jc.log.Debugf("checked user stick calibration: %v", jc.calib)
 		}
 	} else {
-		fmt.Printf("%s: SPI read returned [%x+%d]\n%s", jc.serial, addr, length, hex.Dump(data))
+		jc.log.Debugf("SPI read returned [%x+%d]\n%s", addr, length, hex.Dump(data))
 	}
 
 	jc.mu.Lock()
@@ -0,0 +1,146 @@
+package output
+
+import (
+	"strings"
+
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// fanout forwards updates to several outputs.  An output that fails is
+// skipped for the rest of the update and does not affect the others.
+type fanout struct {
+	outs []jcpc.Output
+	// outputs that returned an error from BeginUpdate, and should not get
+	// the rest of the update.  They still get FlushUpdate, as BeginUpdate
+	// may have taken a lock.
+	skip []bool
+}
+
+// NewFanout creates an Output that sends every update to all of outs.
+func NewFanout(outs ...jcpc.Output) jcpc.Output {
+	if len(outs) == 1 {
+		return outs[0]
+	}
+	return &fanout{
+		outs: outs,
+		skip: make([]bool, len(outs)),
+	}
+}
+
+// FanoutFactory creates an OutputFactory that combines the outputs of
+// several factories with NewFanout.
+func FanoutFactory(factories ...jcpc.OutputFactory) jcpc.OutputFactory {
+	return func(t jcpc.JoyConType, playerNum int, serials []string, remap jcpc.InputRemappingOptions) (jcpc.Output, error) {
+		var outs []jcpc.Output
+		for _, f := range factories {
+			o, err := f(t, playerNum, serials, remap)
+			if err != nil {
+				for _, v := range outs {
+					v.Close()
+				}
+				return nil, err
+			}
+			outs = append(outs, o)
+		}
+		return NewFanout(outs...), nil
+	}
+}
+
+// FanoutError collects the errors from the outputs of a fanout.
+type FanoutError []error
+
+func (e FanoutError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (f *fanout) BeginUpdate() error {
+	var errs FanoutError
+	for i, o := range f.outs {
+		err := o.BeginUpdate()
+		f.skip[i] = err != nil
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(f.outs) {
+		return errs
+	}
+	return nil
+}
+
+func (f *fanout) ButtonUpdate(b jcpc.ButtonID, value bool) {
+	for i, o := range f.outs {
+		if !f.skip[i] {
+			o.ButtonUpdate(b, value)
+		}
+	}
+}
+
+func (f *fanout) StickUpdate(axis jcpc.AxisID, value int16) {
+	for i, o := range f.outs {
+		if !f.skip[i] {
+			o.StickUpdate(axis, value)
+		}
+	}
+}
+
+func (f *fanout) GyroUpdate(vals jcpc.GyroFrame) {
+	for i, o := range f.outs {
+		if !f.skip[i] {
+			o.GyroUpdate(vals)
+		}
+	}
+}
+
+func (f *fanout) FlushUpdate() error {
+	var errs FanoutError
+	for i, o := range f.outs {
+		err := o.FlushUpdate()
+		if err != nil && !f.skip[i] {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func (f *fanout) OnFrame() {
+	for _, o := range f.outs {
+		o.OnFrame()
+	}
+}
+
+func (f *fanout) BindFeedback(r jcpc.Rumbler) {
+	for _, o := range f.outs {
+		if fo, ok := o.(jcpc.FeedbackOutput); ok {
+			fo.BindFeedback(r)
+		}
+	}
+}
+
+func (f *fanout) BindLights(l jcpc.LightSetter) {
+	for _, o := range f.outs {
+		if lo, ok := o.(jcpc.LightsOutput); ok {
+			lo.BindLights(l)
+		}
+	}
+}
+
+func (f *fanout) Close() error {
+	var errs FanoutError
+	for _, o := range f.outs {
+		if err := o.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,576 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// framesPerSecond is the rate OnFrame() is called at.
+const framesPerSecond = 60
+
+// MacroStep is a single event in a recorded or configured macro.
+type MacroStep struct {
+	// Frame is the number of frames after the start of the macro.
+	Frame int
+
+	IsAxis  bool
+	Button  jcpc.ButtonID
+	Pressed bool
+	Axis    jcpc.AxisID
+	Value   int16
+}
+
+// A Macro is a timed sequence of button and stick events, sorted by Frame.
+type Macro []MacroStep
+
+// ParseMacro reads a macro from a space-separated list of steps:
+//
+//	press:A        press the A button
+//	release:A      release the A button
+//	stick:LH:2047  move the left stick horizontal axis (LH, LV, RH, RV)
+//	wait:10        wait for 10 frames (1/60 sec each)
+func ParseMacro(s string) (Macro, error) {
+	var m Macro
+	frame := 0
+	for _, word := range strings.Fields(s) {
+		parts := strings.Split(word, ":")
+		switch parts[0] {
+		case "press", "release":
+			if len(parts) != 2 {
+				return nil, errors.Errorf("bad macro step '%s'", word)
+			}
+			b, ok := jcpc.ParseButton(parts[1])
+			if !ok {
+				return nil, errors.Errorf("unknown button '%s'", parts[1])
+			}
+			m = append(m, MacroStep{Frame: frame, Button: b, Pressed: parts[0] == "press"})
+		case "stick":
+			if len(parts) != 3 {
+				return nil, errors.Errorf("bad macro step '%s'", word)
+			}
+			axis, ok := jcpc.ParseAxis(parts[1])
+			if !ok {
+				return nil, errors.Errorf("unknown axis '%s'", parts[1])
+			}
+			val, err := strconv.ParseInt(parts[2], 0, 16)
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad stick value in '%s'", word)
+			}
+			m = append(m, MacroStep{Frame: frame, IsAxis: true, Axis: axis, Value: int16(val)})
+		case "wait":
+			if len(parts) != 2 {
+				return nil, errors.Errorf("bad macro step '%s'", word)
+			}
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("bad wait in '%s'", word)
+			}
+			frame += n
+		default:
+			return nil, errors.Errorf("bad macro step '%s'", word)
+		}
+	}
+	return m, nil
+}
+
+var axisShortName = map[jcpc.AxisID]string{
+	jcpc.Axis_L_Horiz:    "LH",
+	jcpc.Axis_L_Vertical: "LV",
+	jcpc.Axis_R_Horiz:    "RH",
+	jcpc.Axis_R_Vertical: "RV",
+}
+
+// String formats the macro in the syntax accepted by ParseMacro.
+func (m Macro) String() string {
+	var parts []string
+	frame := 0
+	for _, st := range m {
+		if st.Frame > frame {
+			parts = append(parts, fmt.Sprintf("wait:%d", st.Frame-frame))
+			frame = st.Frame
+		}
+		if st.IsAxis {
+			parts = append(parts, fmt.Sprintf("stick:%s:%d", axisShortName[st.Axis], st.Value))
+		} else if st.Pressed {
+			parts = append(parts, "press:"+st.Button.String())
+		} else {
+			parts = append(parts, "release:"+st.Button.String())
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+type turboState struct {
+	halfPeriod int
+	held       bool
+	count      int
+}
+
+type macroPlayback struct {
+	trigger jcpc.ButtonID
+	m       Macro
+	start   int
+	next    int
+}
+
+type macroRecording struct {
+	trigger jcpc.ButtonID
+	start   int
+	steps   Macro
+}
+
+// Filter wraps an Output and transforms the button stream passing through
+// it, adding turbo (autofire), toggle (latching) buttons and macros.  Timing
+// is driven by OnFrame().
+type Filter struct {
+	out jcpc.Output
+
+	// Locked by BeginUpdate, unlocked by FlushUpdate.  Also held by OnFrame.
+	mu      sync.Mutex
+	enabled bool
+	frame   int
+
+	// button states as sent to out
+	outState map[jcpc.ButtonID]bool
+
+	turbo   map[jcpc.ButtonID]*turboState
+	toggle  map[jcpc.ButtonID]bool
+	macros  map[jcpc.ButtonID]Macro
+	playing []*macroPlayback
+
+	recording *macroRecording
+
+	// buttons set by the last Apply
+	applied []appliedSetting
+}
+
+// appliedSetting is a turbo, toggle or macro entry that came from the
+// controller options.
+type appliedSetting struct {
+	kind string
+	b    jcpc.ButtonID
+}
+
+func (s appliedSetting) in(list []appliedSetting) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var _ jcpc.Output = &Filter{}
+
+func NewFilter(out jcpc.Output) *Filter {
+	return &Filter{
+		out:      out,
+		enabled:  true,
+		outState: make(map[jcpc.ButtonID]bool),
+		turbo:    make(map[jcpc.ButtonID]*turboState),
+		toggle:   make(map[jcpc.ButtonID]bool),
+		macros:   make(map[jcpc.ButtonID]Macro),
+	}
+}
+
+// Apply configures the filter from the controller options.  Errors are
+// reported for invalid entries, but the rest of the options are still
+// applied.
+//
+// Entries of the previous Apply that are no longer in the options are
+// removed.  Entries made at the console are kept unless the options set the
+// same button, or did so before; those are replaced or removed.
+func (f *Filter) Apply(opts jcpc.ControllerOptions) error {
+	var errs []string
+	var applied []appliedSetting
+	for name, hz := range opts.Turbo {
+		b, ok := jcpc.ParseButton(name)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("turbo: unknown button '%s'", name))
+			continue
+		}
+		f.SetTurbo(b, hz)
+		applied = append(applied, appliedSetting{"turbo", b})
+	}
+	for _, name := range opts.Toggle {
+		b, ok := jcpc.ParseButton(name)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("toggle: unknown button '%s'", name))
+			continue
+		}
+		f.SetToggle(b, true)
+		applied = append(applied, appliedSetting{"toggle", b})
+	}
+	for name, str := range opts.Macros {
+		b, ok := jcpc.ParseButton(name)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("macro: unknown button '%s'", name))
+			continue
+		}
+		m, err := ParseMacro(str)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("macro %s: %v", name, err))
+			continue
+		}
+		f.SetMacro(b, m)
+		applied = append(applied, appliedSetting{"macro", b})
+	}
+	f.mu.Lock()
+	prev := f.applied
+	f.applied = applied
+	f.mu.Unlock()
+	for _, s := range prev {
+		if s.in(applied) {
+			continue
+		}
+		switch s.kind {
+		case "turbo":
+			f.SetTurbo(s.b, 0)
+		case "toggle":
+			f.SetToggle(s.b, false)
+		case "macro":
+			f.SetMacro(s.b, nil)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SetEnabled turns the whole filter on or off.  While off, all events are
+// passed through unchanged.
+func (f *Filter) SetEnabled(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.enabled == enabled {
+		return
+	}
+	f.enabled = enabled
+	if !enabled {
+		f.out.BeginUpdate()
+		for _, p := range f.playing {
+			f.releaseMacro(p.m)
+		}
+		f.playing = nil
+		f.resync()
+		f.out.FlushUpdate()
+	}
+}
+
+func (f *Filter) Enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled
+}
+
+// SetTurbo makes b repeat at the given rate (presses per second) while it is
+// held down.  A rate of 0 turns turbo off.
+func (f *Filter) SetTurbo(b jcpc.ButtonID, hz int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if hz <= 0 {
+		delete(f.turbo, b)
+		return
+	}
+	half := framesPerSecond / (2 * hz)
+	if half < 1 {
+		half = 1
+	}
+	f.turbo[b] = &turboState{halfPeriod: half}
+}
+
+// SetToggle makes b latch: the first press holds it down, the second press
+// releases it.
+func (f *Filter) SetToggle(b jcpc.ButtonID, enable bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if enable {
+		f.toggle[b] = true
+	} else {
+		delete(f.toggle, b)
+		if f.outState[b] {
+			f.out.BeginUpdate()
+			f.send(b, false)
+			f.out.FlushUpdate()
+		}
+	}
+}
+
+// SetMacro binds a macro to the trigger button.  A nil macro removes the
+// binding.
+func (f *Filter) SetMacro(trigger jcpc.ButtonID, m Macro) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if m != nil {
+		f.macros[trigger] = m
+		return
+	}
+	delete(f.macros, trigger)
+
+	// stop playing the removed macro
+	var stopped []*macroPlayback
+	k := 0
+	for _, p := range f.playing {
+		if p.trigger == trigger {
+			stopped = append(stopped, p)
+		} else {
+			f.playing[k] = p
+			k++
+		}
+	}
+	f.playing = f.playing[:k]
+	if len(stopped) > 0 {
+		f.out.BeginUpdate()
+		for _, p := range stopped {
+			f.releaseMacro(p.m)
+		}
+		f.out.FlushUpdate()
+	}
+}
+
+// StartRecording records all events passing through the filter until
+// StopRecording is called, then binds them to the trigger button.
+func (f *Filter) StartRecording(trigger jcpc.ButtonID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.recording = &macroRecording{trigger: trigger, start: -1}
+}
+
+// StopRecording finishes a recording started by StartRecording and returns
+// the recorded macro.
+func (f *Filter) StopRecording() (jcpc.ButtonID, Macro, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rec := f.recording
+	if rec == nil {
+		return 0, nil, errors.Errorf("not recording")
+	}
+	f.recording = nil
+	if len(rec.steps) == 0 {
+		return rec.trigger, nil, errors.Errorf("no events recorded")
+	}
+	f.macros[rec.trigger] = rec.steps
+	return rec.trigger, rec.steps, nil
+}
+
+// Describe returns a human-readable summary of the filter configuration.
+func (f *Filter) Describe() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var lines []string
+	if f.enabled {
+		lines = append(lines, "filter: on")
+	} else {
+		lines = append(lines, "filter: off")
+	}
+	for b, t := range f.turbo {
+		lines = append(lines, fmt.Sprintf("turbo %s: %d/sec", b, framesPerSecond/(2*t.halfPeriod)))
+	}
+	for b := range f.toggle {
+		lines = append(lines, fmt.Sprintf("toggle %s", b))
+	}
+	for b, m := range f.macros {
+		lines = append(lines, fmt.Sprintf("macro %s: %s", b, m))
+	}
+	if f.recording != nil {
+		lines = append(lines, fmt.Sprintf("recording macro for %s", f.recording.trigger))
+	}
+	sort.Strings(lines[1:])
+	return strings.Join(lines, "\n")
+}
+
+// mu must be held
+func (f *Filter) send(b jcpc.ButtonID, state bool) {
+	if f.outState[b] == state {
+		return
+	}
+	f.outState[b] = state
+	f.out.ButtonUpdate(b, state)
+}
+
+// mu must be held, inside of an out.BeginUpdate()
+//
+// Releases everything that the filter is holding down on its own.
+func (f *Filter) resync() {
+	for b, t := range f.turbo {
+		f.send(b, t.held)
+	}
+	for b := range f.toggle {
+		f.send(b, false)
+	}
+}
+
+// mu must be held, inside of an out.BeginUpdate()
+//
+// Releases the buttons and centers the sticks used by a macro that is
+// stopped before it finishes.
+func (f *Filter) releaseMacro(m Macro) {
+	for _, st := range m {
+		if st.IsAxis {
+			f.out.StickUpdate(st.Axis, 0)
+		} else {
+			f.send(st.Button, false)
+		}
+	}
+}
+
+func (f *Filter) BeginUpdate() error {
+	f.mu.Lock()
+	return f.out.BeginUpdate()
+}
+
+func (f *Filter) ButtonUpdate(b jcpc.ButtonID, state bool) {
+	if rec := f.recording; rec != nil && b != rec.trigger {
+		if rec.start == -1 {
+			rec.start = f.frame
+		}
+		rec.steps = append(rec.steps, MacroStep{Frame: f.frame - rec.start, Button: b, Pressed: state})
+	}
+	if t, ok := f.turbo[b]; ok {
+		t.held = state
+		t.count = 0
+	}
+	if !f.enabled || f.recording != nil {
+		f.send(b, state)
+		return
+	}
+
+	if m, ok := f.macros[b]; ok {
+		if state {
+			f.playing = append(f.playing, &macroPlayback{trigger: b, m: m, start: f.frame})
+		}
+		return
+	}
+	if f.toggle[b] {
+		if state {
+			f.send(b, !f.outState[b])
+		}
+		return
+	}
+	f.send(b, state)
+}
+
+func (f *Filter) StickUpdate(axis jcpc.AxisID, value int16) {
+	if rec := f.recording; rec != nil {
+		if rec.start == -1 {
+			rec.start = f.frame
+		}
+		rec.steps = append(rec.steps, MacroStep{Frame: f.frame - rec.start, IsAxis: true, Axis: axis, Value: value})
+	}
+	f.out.StickUpdate(axis, value)
+}
+
+func (f *Filter) GyroUpdate(vals jcpc.GyroFrame) {
+	f.out.GyroUpdate(vals)
+}
+
+func (f *Filter) FlushUpdate() error {
+	defer f.mu.Unlock()
+	return f.out.FlushUpdate()
+}
+
+// OnFrame advances turbo buttons and macro playback by one frame.
+func (f *Filter) OnFrame() {
+	f.mu.Lock()
+	f.frame++
+	if f.enabled && f.recording == nil && (len(f.turbo) > 0 || len(f.playing) > 0) {
+		f.out.BeginUpdate()
+		f.stepTurbo()
+		f.stepMacros()
+		err := f.out.FlushUpdate()
+		if err != nil {
+			log.Warnf("output error: %v", err)
+		}
+	}
+	f.mu.Unlock()
+
+	f.out.OnFrame()
+}
+
+// mu must be held
+func (f *Filter) stepTurbo() {
+	for b, t := range f.turbo {
+		if !t.held {
+			continue
+		}
+		t.count++
+		if t.count >= t.halfPeriod {
+			t.count = 0
+			f.send(b, !f.outState[b])
+		}
+	}
+}
+
+// mu must be held
+func (f *Filter) stepMacros() {
+	k := 0
+	for _, p := range f.playing {
+		elapsed := f.frame - p.start
+		for p.next < len(p.m) && p.m[p.next].Frame <= elapsed {
+			st := p.m[p.next]
+			if st.IsAxis {
+				f.out.StickUpdate(st.Axis, st.Value)
+			} else {
+				f.send(st.Button, st.Pressed)
+			}
+			p.next++
+		}
+		if p.next < len(p.m) {
+			f.playing[k] = p
+			k++
+		} else {
+			// don't leave anything held down
+			for _, st := range p.m {
+				if !st.IsAxis {
+					f.send(st.Button, false)
+				}
+			}
+		}
+	}
+	f.playing = f.playing[:k]
+}
+
+// BindFeedback passes force feedback from the wrapped output through to r.
+func (f *Filter) BindFeedback(r jcpc.Rumbler) {
+	if fo, ok := f.out.(jcpc.FeedbackOutput); ok {
+		fo.BindFeedback(r)
+	}
+}
+
+// BindLights passes player lights from the wrapped output through to l.
+func (f *Filter) BindLights(l jcpc.LightSetter) {
+	if lo, ok := f.out.(jcpc.LightsOutput); ok {
+		lo.BindLights(l)
+	}
+}
+
+// SetOutput replaces the wrapped output and returns the old one, keeping the
+// filter settings.  Bind feedback and lights again afterwards.
+func (f *Filter) SetOutput(out jcpc.Output) jcpc.Output {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.out
+	f.out = out
+	// nothing is held on the new output
+	f.outState = make(map[jcpc.ButtonID]bool)
+	return old
+}
+
+func (f *Filter) Close() error {
+	return f.out.Close()
+}
@@ -0,0 +1,233 @@
+package output
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// recordingOutput remembers the state it was sent and logs every change.
+type recordingOutput struct {
+	frame   int
+	buttons map[jcpc.ButtonID]bool
+	sticks  map[jcpc.AxisID]int16
+	events  []string
+}
+
+func newRecordingOutput() *recordingOutput {
+	return &recordingOutput{
+		buttons: make(map[jcpc.ButtonID]bool),
+		sticks:  make(map[jcpc.AxisID]int16),
+	}
+}
+
+func (o *recordingOutput) BeginUpdate() error { return nil }
+func (o *recordingOutput) ButtonUpdate(b jcpc.ButtonID, value bool) {
+	o.buttons[b] = value
+	o.events = append(o.events, fmt.Sprintf("%d %s %v", o.frame, b, value))
+}
+func (o *recordingOutput) StickUpdate(axis jcpc.AxisID, value int16) {
+	o.sticks[axis] = value
+	o.events = append(o.events, fmt.Sprintf("%d %s %d", o.frame, axisShortName[axis], value))
+}
+func (o *recordingOutput) GyroUpdate(vals jcpc.GyroFrame) {}
+func (o *recordingOutput) FlushUpdate() error             { return nil }
+func (o *recordingOutput) OnFrame()                       { o.frame++ }
+func (o *recordingOutput) Close() error                   { return nil }
+
+func press(f *Filter, b jcpc.ButtonID, state bool) {
+	f.BeginUpdate()
+	f.ButtonUpdate(b, state)
+	f.FlushUpdate()
+}
+
+func frames(f *Filter, n int) {
+	for i := 0; i < n; i++ {
+		f.OnFrame()
+	}
+}
+
+func mustParseMacro(t *testing.T, s string) Macro {
+	m, err := ParseMacro(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTurbo(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	f.SetTurbo(jcpc.Button_R_A, 10)
+
+	press(f, jcpc.Button_R_A, true)
+	if !out.buttons[jcpc.Button_R_A] {
+		t.Fatal("A not pressed right away")
+	}
+	out.events = nil
+	frames(f, framesPerSecond)
+	presses := 0
+	for _, e := range out.events {
+		if e[len(e)-4:] == "true" {
+			presses++
+		}
+	}
+	if presses != 10 {
+		t.Errorf("%d presses in one second, want 10: %v", presses, out.events)
+	}
+
+	press(f, jcpc.Button_R_A, false)
+	out.events = nil
+	frames(f, 10)
+	if out.buttons[jcpc.Button_R_A] || len(out.events) != 0 {
+		t.Errorf("still repeating after release: %v", out.events)
+	}
+}
+
+func TestToggle(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	f.SetToggle(jcpc.Button_R_B, true)
+
+	for i, want := range []bool{true, true, false, false, true} {
+		press(f, jcpc.Button_R_B, i%2 == 0)
+		if out.buttons[jcpc.Button_R_B] != want {
+			t.Errorf("event %d: B is %v, want %v", i, out.buttons[jcpc.Button_R_B], want)
+		}
+	}
+
+	f.SetToggle(jcpc.Button_R_B, false)
+	if out.buttons[jcpc.Button_R_B] {
+		t.Error("B still latched after turning toggle off")
+	}
+}
+
+func TestMacroPlayback(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	f.SetMacro(jcpc.Button_R_X, mustParseMacro(t, "press:A wait:2 stick:LH:1000 wait:1 release:A press:B"))
+
+	press(f, jcpc.Button_R_X, true)
+	press(f, jcpc.Button_R_X, false)
+	frames(f, 5)
+	// events sent on a frame are logged before the output's OnFrame
+	want := []string{"0 A true", "1 LH 1000", "2 A false", "2 B true", "2 B false"}
+	if fmt.Sprint(out.events) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", out.events, want)
+	}
+}
+
+func TestMacroRecording(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	f.StartRecording(jcpc.Button_R_Y)
+
+	frames(f, 3)
+	press(f, jcpc.Button_R_A, true)
+	if !out.buttons[jcpc.Button_R_A] {
+		t.Error("A not passed through while recording")
+	}
+	frames(f, 5)
+	f.BeginUpdate()
+	f.StickUpdate(jcpc.Axis_L_Vertical, -300)
+	f.ButtonUpdate(jcpc.Button_R_A, false)
+	f.FlushUpdate()
+
+	trigger, m, err := f.StopRecording()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trigger != jcpc.Button_R_Y {
+		t.Errorf("trigger %s", trigger)
+	}
+	if s := m.String(); s != "press:A wait:5 stick:LV:-300 release:A" {
+		t.Errorf("recorded %q", s)
+	}
+	if _, _, err := f.StopRecording(); err == nil {
+		t.Error("StopRecording succeeded twice")
+	}
+}
+
+func TestDisableResync(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	f.SetTurbo(jcpc.Button_R_A, 10)
+	f.SetToggle(jcpc.Button_R_B, true)
+
+	press(f, jcpc.Button_R_A, true)
+	frames(f, 3)
+	if out.buttons[jcpc.Button_R_A] {
+		t.Fatal("turbo did not release A")
+	}
+	press(f, jcpc.Button_R_B, true)
+	press(f, jcpc.Button_R_B, false)
+
+	f.SetEnabled(false)
+	if !out.buttons[jcpc.Button_R_A] {
+		t.Error("held A not pressed after disabling turbo")
+	}
+	if out.buttons[jcpc.Button_R_B] {
+		t.Error("latched B not released")
+	}
+
+	out.events = nil
+	out.frame = 0
+	frames(f, 10)
+	press(f, jcpc.Button_R_B, true)
+	press(f, jcpc.Button_R_B, false)
+	want := []string{"10 B true", "10 B false"}
+	if fmt.Sprint(out.events) != fmt.Sprint(want) {
+		t.Errorf("disabled filter sent %v, want %v", out.events, want)
+	}
+}
+
+func TestReleaseOnDisable(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	f.SetMacro(jcpc.Button_R_X, mustParseMacro(t, "press:A stick:RV:-2000 wait:30 release:A"))
+
+	press(f, jcpc.Button_R_X, true)
+	frames(f, 2)
+	if !out.buttons[jcpc.Button_R_A] || out.sticks[jcpc.Axis_R_Vertical] != -2000 {
+		t.Fatalf("macro did not start: %v", out.events)
+	}
+
+	f.SetEnabled(false)
+	if out.buttons[jcpc.Button_R_A] || out.sticks[jcpc.Axis_R_Vertical] != 0 {
+		t.Errorf("macro input left behind: %v", out.events)
+	}
+	out.events = nil
+	frames(f, 40)
+	if len(out.events) != 0 {
+		t.Errorf("macro kept playing: %v", out.events)
+	}
+}
+
+func TestReleaseOnApply(t *testing.T) {
+	out := newRecordingOutput()
+	f := NewFilter(out)
+	err := f.Apply(jcpc.ControllerOptions{Macros: map[string]string{"X": "press:A stick:LH:500 wait:30 release:A"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	press(f, jcpc.Button_R_X, true)
+	frames(f, 2)
+	if !out.buttons[jcpc.Button_R_A] {
+		t.Fatalf("macro did not start: %v", out.events)
+	}
+
+	err = f.Apply(jcpc.ControllerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.buttons[jcpc.Button_R_A] || out.sticks[jcpc.Axis_L_Horiz] != 0 {
+		t.Errorf("removed macro left input behind: %v", out.events)
+	}
+	out.events = nil
+	frames(f, 40)
+	if len(out.events) != 0 {
+		t.Errorf("removed macro kept playing: %v", out.events)
+	}
+}
@@ -1,6 +1,14 @@
 package output
 
-import "github.com/riking/joycon/prog4/jcpc"
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/riking/joycon/prog4/jclog"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+var log = jclog.New("output")
 
 type commonKeyMap struct {
 	Button jcpc.ButtonID
@@ -16,6 +24,22 @@ type commonStickMap struct {
 type ControllerMapping struct {
 	Keys []commonKeyMap
 	Axes []commonStickMap
+
+	// Alternate mappings used while a shift button is held down.  None by
+	// default, see LayersL.
+	Layers []ShiftLayer
+}
+
+// ShiftLayer is an alternate mapping that is active while the Shift button
+// is held down.  Buttons and axes that are not listed in the layer keep
+// their normal mapping.
+//
+// The Shift button itself is only reported if it is tapped without pressing
+// any other button.
+type ShiftLayer struct {
+	Shift jcpc.ButtonID
+	Keys  []commonKeyMap
+	Axes  []commonStickMap
 }
 
 // https://w3c.github.io/gamepad/#remapping
@@ -23,12 +47,15 @@ type ControllerMapping struct {
 // System expects negative left/up, positive right/down
 // screencheat expects positive up
 
+// MappingL and MappingR are for a single Joy-Con held upright.  The
+// controller rotates the input for other orientations, see
+// jcpc.Orientation.
 var MappingL = ControllerMapping{
 	Keys: []commonKeyMap{
-		{jcpc.Button_L_Left, "GamepadSouth"},
-		{jcpc.Button_L_Right, "GamepadNorth"},
-		{jcpc.Button_L_Up, "GamepadWest"},
-		{jcpc.Button_L_Down, "GamepadEast"},
+		{jcpc.Button_L_Down, "GamepadSouth"},
+		{jcpc.Button_L_Up, "GamepadNorth"},
+		{jcpc.Button_L_Left, "GamepadWest"},
+		{jcpc.Button_L_Right, "GamepadEast"},
 
 		{jcpc.Button_L_SL, "GamepadTL"},
 		{jcpc.Button_L_SR, "GamepadTR"},
@@ -38,19 +65,22 @@ var MappingL = ControllerMapping{
 		{jcpc.Button_Capture, "GamepadStart"},
 		{jcpc.Button_Minus, "GamepadSelect"},
 		{jcpc.Button_L_Stick, "GamepadLStick"},
+
+		{jcpc.Button_Capture.Virtual(jcpc.PressLong), "GamepadExtra9"},
+		{jcpc.Button_Capture.Virtual(jcpc.PressDouble), "GamepadExtra10"},
 	},
 	Axes: []commonStickMap{
-		{jcpc.Axis_L_Vertical, false, "MainStickHoriz"},
-		{jcpc.Axis_L_Horiz, false, "MainStickVertical"},
+		{jcpc.Axis_L_Horiz, true, "MainStickHoriz"},
+		{jcpc.Axis_L_Vertical, false, "MainStickVertical"},
 	},
 }
 
 var MappingR = ControllerMapping{
 	Keys: []commonKeyMap{
-		{jcpc.Button_R_A, "GamepadSouth"},
-		{jcpc.Button_R_Y, "GamepadNorth"},
-		{jcpc.Button_R_B, "GamepadWest"},
-		{jcpc.Button_R_X, "GamepadEast"},
+		{jcpc.Button_R_B, "GamepadSouth"},
+		{jcpc.Button_R_X, "GamepadNorth"},
+		{jcpc.Button_R_Y, "GamepadWest"},
+		{jcpc.Button_R_A, "GamepadEast"},
 
 		{jcpc.Button_R_SL, "GamepadTL"},
 		{jcpc.Button_R_SR, "GamepadTR"},
@@ -60,10 +90,13 @@ var MappingR = ControllerMapping{
 		{jcpc.Button_Home, "GamepadStart"},
 		{jcpc.Button_Plus, "GamepadSelect"},
 		{jcpc.Button_R_Stick, "GamepadLStick"},
+
+		{jcpc.Button_Home.Virtual(jcpc.PressLong), "GamepadExtra9"},
+		{jcpc.Button_Home.Virtual(jcpc.PressDouble), "GamepadExtra10"},
 	},
 	Axes: []commonStickMap{
-		{jcpc.Axis_R_Vertical, true, "MainStickHoriz"},
-		{jcpc.Axis_R_Horiz, true, "MainStickVertical"},
+		{jcpc.Axis_R_Horiz, true, "MainStickHoriz"},
+		{jcpc.Axis_R_Vertical, false, "MainStickVertical"},
 	},
 }
 
@@ -96,6 +129,11 @@ var MappingDual = ControllerMapping{
 		{jcpc.Button_Minus, "GamepadSelect"},
 		{jcpc.Button_R_Stick, "GamepadRStick"},
 		{jcpc.Button_L_Stick, "GamepadLStick"},
+
+		{jcpc.Button_Home.Virtual(jcpc.PressLong), "GamepadExtra9"},
+		{jcpc.Button_Home.Virtual(jcpc.PressDouble), "GamepadExtra10"},
+		{jcpc.Button_Capture.Virtual(jcpc.PressLong), "GamepadExtra11"},
+		{jcpc.Button_Capture.Virtual(jcpc.PressDouble), "GamepadExtra12"},
 	},
 	Axes: []commonStickMap{
 		{jcpc.Axis_L_Horiz, true, "MainStickHoriz"},
@@ -105,12 +143,95 @@ var MappingDual = ControllerMapping{
 	},
 }
 
+// LayersL, LayersR and LayersDual are the shift layers for MappingL,
+// MappingR and MappingDual.  They are only used with
+// InputRemappingOptions.ShiftLayers, as they take Capture and Home away from
+// the mapped buttons while held.
+var LayersL = []ShiftLayer{
+	{
+		Shift: jcpc.Button_Capture,
+		Keys: []commonKeyMap{
+			{jcpc.Button_L_Down, "GamepadD-Down"},
+			{jcpc.Button_L_Up, "GamepadD-Up"},
+			{jcpc.Button_L_Left, "GamepadD-Left"},
+			{jcpc.Button_L_Right, "GamepadD-Right"},
+
+			{jcpc.Button_L_SL, "GamepadExtra1"},
+			{jcpc.Button_L_SR, "GamepadExtra2"},
+			{jcpc.Button_L_Stick, "GamepadRStick"},
+		},
+		Axes: []commonStickMap{
+			{jcpc.Axis_L_Horiz, true, "SecondStickHoriz"},
+			{jcpc.Axis_L_Vertical, false, "SecondStickVertical"},
+		},
+	},
+}
+
+var LayersR = []ShiftLayer{
+	{
+		Shift: jcpc.Button_Home,
+		Keys: []commonKeyMap{
+			{jcpc.Button_R_B, "GamepadD-Down"},
+			{jcpc.Button_R_X, "GamepadD-Up"},
+			{jcpc.Button_R_Y, "GamepadD-Left"},
+			{jcpc.Button_R_A, "GamepadD-Right"},
+
+			{jcpc.Button_R_SL, "GamepadExtra1"},
+			{jcpc.Button_R_SR, "GamepadExtra2"},
+			{jcpc.Button_R_Stick, "GamepadRStick"},
+		},
+		Axes: []commonStickMap{
+			{jcpc.Axis_R_Horiz, true, "SecondStickHoriz"},
+			{jcpc.Axis_R_Vertical, false, "SecondStickVertical"},
+		},
+	},
+}
+
+var LayersDual = []ShiftLayer{
+	{
+		Shift: jcpc.Button_Capture,
+		Keys: []commonKeyMap{
+			{jcpc.Button_R_B, "GamepadExtra5"},
+			{jcpc.Button_R_X, "GamepadExtra6"},
+			{jcpc.Button_R_Y, "GamepadExtra7"},
+			{jcpc.Button_R_A, "GamepadExtra8"},
+		},
+	},
+}
+
 func RemapInputs(mappings *ControllerMapping, mods jcpc.InputRemappingOptions) {
-	for _, searched := range mods.InvertedAxes {
-		for i, axis := range mappings.Axes {
+	// copy before modifying, the slices are shared with the Mapping* globals
+	mappings.Axes = invertAxes(mappings.Axes, mods.InvertedAxes)
+	layers := make([]ShiftLayer, len(mappings.Layers))
+	for i, l := range mappings.Layers {
+		layers[i] = l
+		layers[i].Axes = invertAxes(l.Axes, mods.InvertedAxes)
+	}
+	mappings.Layers = layers
+}
+
+func invertAxes(axes []commonStickMap, inverted []jcpc.AxisID) []commonStickMap {
+	result := make([]commonStickMap, len(axes))
+	copy(result, axes)
+	for _, searched := range inverted {
+		for i, axis := range result {
 			if axis.Axis == searched {
-				mappings.Axes[i].Invert = !axis.Invert
+				result[i].Invert = !axis.Invert
 			}
 		}
 	}
+	return result
+}
+
+// layoutVersion returns a device version number that changes whenever the
+// mapping or the output options change, so that games don't reuse bindings
+// made for a different layout.  The mapping must already be remapped.
+func layoutVersion(m ControllerMapping, mods jcpc.InputRemappingOptions) uint16 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v %v %v", m, mods.AnalogTriggers, mods.HatDPad)
+	v := uint16(h.Sum32() ^ h.Sum32()>>16)
+	if v == 0 {
+		v = 1
+	}
+	return v
 }
@@ -39,6 +39,14 @@ var linuxKeyNames = []linuxKeyCode{
 	{"GamepadExtra6", C.BTN_TRIGGER_HAPPY + 5},
 	{"GamepadExtra7", C.BTN_TRIGGER_HAPPY + 6},
 	{"GamepadExtra8", C.BTN_TRIGGER_HAPPY + 7},
+	{"GamepadExtra9", C.BTN_TRIGGER_HAPPY + 8},
+	{"GamepadExtra10", C.BTN_TRIGGER_HAPPY + 9},
+	{"GamepadExtra11", C.BTN_TRIGGER_HAPPY + 10},
+	{"GamepadExtra12", C.BTN_TRIGGER_HAPPY + 11},
+	{"GamepadExtra13", C.BTN_TRIGGER_HAPPY + 12},
+	{"GamepadExtra14", C.BTN_TRIGGER_HAPPY + 13},
+	{"GamepadExtra15", C.BTN_TRIGGER_HAPPY + 14},
+	{"GamepadExtra16", C.BTN_TRIGGER_HAPPY + 15},
 }
 
 var linuxAxisNames = []linuxKeyCode{
@@ -49,7 +57,17 @@ var linuxAxisNames = []linuxKeyCode{
 	{"SecondStickVertical", C.ABS_RZ},
 }
 
+// Used when the triggers are analog, as they need ABS_Z and ABS_RZ.  This is
+// the xpad layout that SDL and Steam expect from a gamepad with triggers.
+var linuxStandardAxisNames = []linuxKeyCode{
+	{"MainStickHoriz", C.ABS_X},
+	{"MainStickVertical", C.ABS_Y},
+	{"SecondStickHoriz", C.ABS_RX},
+	{"SecondStickVertical", C.ABS_RY},
+}
+
 var linuxKeyMap = make(map[string]uint16)
+var linuxStandardAxisMap = make(map[string]uint16)
 
 func init() {
 	for _, e := range linuxKeyNames {
@@ -58,13 +76,20 @@ func init() {
 	for _, e := range linuxAxisNames {
 		linuxKeyMap[e.Name] = e.Value
 	}
+	for _, e := range linuxStandardAxisNames {
+		linuxStandardAxisMap[e.Name] = e.Value
+	}
 }
 
 // TODO should this return errors
 func commonMappingToInternal(m ControllerMapping) internalKeyCodeMapping {
+	return keysToInternal(m.Keys)
+}
+
+func keysToInternal(keys []commonKeyMap) internalKeyCodeMapping {
 	var r internalKeyCodeMapping
 
-	for _, v := range m.Keys {
+	for _, v := range keys {
 		if v.Name == "" {
 			continue
 		}
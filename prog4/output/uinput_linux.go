@@ -11,6 +11,7 @@ import (
 	"unsafe"
 
 	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
 	"github.com/riking/joycon/prog4/jcpc"
 	"golang.org/x/sys/unix"
 )
@@ -19,7 +20,11 @@ import (
 #include <linux/input.h>
 //#include <linux/uinput.h>
 #include "uinput_linux.h"
+#include <errno.h>
 #include <stddef.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/ioctl.h>
 #include <unistd.h>
 
 static const struct input_event sample_ev;
@@ -37,25 +42,125 @@ int read_uinput_path(int fd, char *buf, size_t maxlen) {
 		buf);
 }
 
+// Answers a UI_FF_UPLOAD request.  Only rumble effects are accepted.
+// Returns the effect ID, or -1.
+int ff_upload(int fd, unsigned int request_id, unsigned short *strong, unsigned short *weak, unsigned short *length) {
+	struct uinput_ff_upload up;
+	memset(&up, 0, sizeof(up));
+	up.request_id = request_id;
+	if (ioctl(fd, UI_BEGIN_FF_UPLOAD, &up) < 0) {
+		return -1;
+	}
+	if (up.effect.type == FF_RUMBLE) {
+		*strong = up.effect.u.rumble.strong_magnitude;
+		*weak = up.effect.u.rumble.weak_magnitude;
+		*length = up.effect.replay.length;
+		up.retval = 0;
+	} else {
+		up.retval = -EINVAL;
+	}
+	if (ioctl(fd, UI_END_FF_UPLOAD, &up) < 0 || up.retval != 0) {
+		return -1;
+	}
+	return up.effect.id;
+}
+
+// Answers a UI_FF_ERASE request.  Returns the effect ID, or -1.
+int ff_erase(int fd, unsigned int request_id) {
+	struct uinput_ff_erase erase;
+	memset(&erase, 0, sizeof(erase));
+	erase.request_id = request_id;
+	if (ioctl(fd, UI_BEGIN_FF_ERASE, &erase) < 0) {
+		return -1;
+	}
+	erase.retval = 0;
+	if (ioctl(fd, UI_END_FF_ERASE, &erase) < 0) {
+		return -1;
+	}
+	return erase.effect_id;
+}
+
 */
 import "C"
 
 // gyro resolution is 4096 points/g because it's value of 4096 at rest
 // To send gyro events, we need multiple event nodes (!)
 
-// ??
-const ff_effects_max = 1
+const ff_effects_max = 16
+
+// Force feedback effects longer than this, or with no length, are cut off.
+const ffMaxFrames = 120
+
+type ffEffect struct {
+	strong, weak uint16
+	lengthMs     uint16
+}
+
+// DeviceID identifies a virtual device to games, so that their per-device
+// bindings survive reconnects.
+type DeviceID struct {
+	Product uint16
+	// Unique per physical controller, e.g. the JoyCon serial numbers
+	Uniq string
+}
 
 type uinput struct {
 	fd      int
 	gyro_fd int
+	log     *jclog.Logger
 
-	buttons internalKeyCodeMapping
-	axes    []commonStickMap
+	buttons   internalKeyCodeMapping
+	axes      []commonStickMap
+	layers    []internalLayer
+	axisCodes map[string]uint16
+
+	analogTriggers bool
+	hatDPad        bool
+	// pressed state of the D-pad buttons, for hat output
+	dpad [4]bool
 
 	// Locked by BeginUpdate, unlocked by FlushUpdate
 	mu      sync.Mutex
 	pending []uinputEvent
+
+	// index into layers, or -1
+	activeLayer int
+	// true until a button other than the shift button is pressed
+	shiftTap bool
+	// key release to send on the next frame after a shift button tap
+	tapRelease uint16
+	// the key code sent for each held button, so that the release matches
+	// the press even if the active layer changed
+	pressedCodes [jcpc.NumButtonIndexes]uint16
+	stickValues  [4]int16
+
+	// force feedback
+	rumbler jcpc.Rumbler
+	effects map[int]ffEffect
+
+	// player lights set by the host, see ledCodes
+	lights jcpc.LightSetter
+	leds   [len(ledCodes)]bool
+}
+
+// LEDs advertised by the device.  The first four are the player lights,
+// LED_MISC makes the lit player lights flash.
+var ledCodes = [5]uint16{C.LED_NUML, C.LED_CAPSL, C.LED_SCROLLL, C.LED_COMPOSE, C.LED_MISC}
+
+// absAxis describes an absolute axis advertised by the device.
+type absAxis struct {
+	code       uint16
+	min, max   int32
+	fuzz, flat int32
+}
+
+// Order matches the dpad field.
+var dpadCodes = [4]uint16{C.BTN_DPAD_UP, C.BTN_DPAD_DOWN, C.BTN_DPAD_LEFT, C.BTN_DPAD_RIGHT}
+
+type internalLayer struct {
+	shift   int // button index
+	buttons internalKeyCodeMapping
+	axes    []commonStickMap
 }
 
 func (o *uinput) ui_ioctl(code, val uintptr) error {
@@ -87,7 +192,15 @@ type uinputEvent struct {
 }
 
 type internalKeyCodeMapping struct {
-	KeyCodes [3 * 8]uint16 // 3 bytes * 8 bits -> uinput key code
+	KeyCodes [jcpc.NumButtonIndexes]uint16 // 3 bytes * 8 bits (* virtual buttons) -> uinput key code
+}
+
+func decodeUinputEvent(p []byte) uinputEvent {
+	return uinputEvent{
+		Type:  binary.LittleEndian.Uint16(p[C.offset_of_type:]),
+		Code:  binary.LittleEndian.Uint16(p[C.offset_of_code:]),
+		Value: int32(binary.LittleEndian.Uint32(p[C.offset_of_value:])),
+	}
 }
 
 func (u uinputEvent) EncodeTo(p []byte) int {
@@ -98,12 +211,12 @@ func (u uinputEvent) EncodeTo(p []byte) int {
 	return C.sizeof_struct_input_event
 }
 
-func (o *uinput) setupNewKernel(m ControllerMapping, name string) error {
+func (o *uinput) setupNewKernel(m ControllerMapping, name string, id DeviceID, version uint16) error {
 	var setup C.struct_uinput_setup
 	setup.id.bustype = C.BUS_BLUETOOTH
 	setup.id.vendor = jcpc.VENDOR_NINTENDO
-	setup.id.product = jcpc.JOYCON_PRODUCT_FAKE
-	setup.id.version = 1
+	setup.id.product = C.__u16(id.Product)
+	setup.id.version = C.__u16(version)
 	setup.ff_effects_max = ff_effects_max
 	for i, v := range []byte(name) {
 		setup.name[i] = C.char(v)
@@ -125,21 +238,17 @@ func (o *uinput) setupNewKernel(m ControllerMapping, name string) error {
 			resolution int32
 		}
 	}
-	abs_setup.absinfo.value = 0
-	abs_setup.absinfo.min = -0x7FF
-	abs_setup.absinfo.max = 0x7FF
-	abs_setup.absinfo.fuzz = 4
-	abs_setup.absinfo.flat = 4
-	o.axes = m.Axes
-	for _, e := range o.axes {
-		if e.Name == "" {
-			continue
-		}
-		code, ok := linuxKeyMap[e.Name]
-		if !ok {
-			return errors.Errorf("Unrecognized axis name '%s'", e.Name)
-		}
-		abs_setup.code = code
+	axes, err := o.absAxes(m)
+	if err != nil {
+		return err
+	}
+	for _, a := range axes {
+		abs_setup.code = a.code
+		abs_setup.absinfo.value = 0
+		abs_setup.absinfo.min = a.min
+		abs_setup.absinfo.max = a.max
+		abs_setup.absinfo.fuzz = a.fuzz
+		abs_setup.absinfo.flat = a.flat
 		err = o.ui_ioctl(C.UI_ABS_SETUP, uintptr(unsafe.Pointer(&abs_setup)))
 		if err != nil {
 			return errors.Wrap(err, "ioctl uinput_abs_setup")
@@ -148,34 +257,30 @@ func (o *uinput) setupNewKernel(m ControllerMapping, name string) error {
 	return nil
 }
 
-func (o *uinput) setupOldKernel(m ControllerMapping, name string) error {
+func (o *uinput) setupOldKernel(m ControllerMapping, name string, id DeviceID, version uint16) error {
 	var setup C.struct_uinput_user_dev
 	setup.id.bustype = C.BUS_BLUETOOTH
 	setup.id.vendor = jcpc.VENDOR_NINTENDO
-	setup.id.product = jcpc.JOYCON_PRODUCT_FAKE
-	setup.id.version = 1
+	setup.id.product = C.__u16(id.Product)
+	setup.id.version = C.__u16(version)
 	for i, v := range []byte(name) {
 		setup.name[i] = C.char(v)
 	}
 	setup.ff_effects_max = ff_effects_max
 
-	o.axes = m.Axes
+	axes, err := o.absAxes(m)
+	if err != nil {
+		return err
+	}
 	maxAxis := uint16(0)
-	for _, e := range o.axes {
-		if e.Name == "" {
-			continue
-		}
-		code, ok := linuxKeyMap[e.Name]
-		if !ok {
-			return errors.Errorf("Unrecognized axis name '%s'", e.Name)
-		}
-		if code > maxAxis {
-			maxAxis = code
+	for _, a := range axes {
+		if a.code > maxAxis {
+			maxAxis = a.code
 		}
-		setup.absmin[code] = -0x7FF
-		setup.absmax[code] = 0x7FF
-		setup.absflat[code] = 4
-		setup.absfuzz[code] = 4
+		setup.absmin[a.code] = C.__s32(a.min)
+		setup.absmax[a.code] = C.__s32(a.max)
+		setup.absflat[a.code] = C.__s32(a.flat)
+		setup.absfuzz[a.code] = C.__s32(a.fuzz)
 	}
 
 	for code := uint16(0); code <= maxAxis; code++ {
@@ -194,11 +299,80 @@ func (o *uinput) setupOldKernel(m ControllerMapping, name string) error {
 	return nil
 }
 
-func NewUInput(m ControllerMapping, name string, remaps jcpc.InputRemappingOptions) (jcpc.Output, error) {
+// setIdentity sets the phys string of the device.  uinput has no way to set
+// uniq, so phys carries the serial numbers.  Must be called before the
+// device is created.
+func (o *uinput) setIdentity(id DeviceID) error {
+	if id.Uniq == "" {
+		return nil
+	}
+	phys := C.CString("joycon/" + id.Uniq)
+	defer C.free(unsafe.Pointer(phys))
+	err := o.ui_ioctl(C.UI_SET_PHYS, uintptr(unsafe.Pointer(phys)))
+	if err != nil {
+		return errors.Wrap(err, "ioctl uinput_set_phys")
+	}
+	return nil
+}
+
+// absAxes returns the absolute axes to advertise for the mapping.
+func (o *uinput) absAxes(m ControllerMapping) ([]absAxis, error) {
+	var result []absAxis
+	seen := make(map[uint16]bool)
+	for _, e := range allAxes(m) {
+		if e.Name == "" {
+			continue
+		}
+		code, ok := o.axisCodes[e.Name]
+		if !ok {
+			return nil, errors.Errorf("Unrecognized axis name '%s'", e.Name)
+		}
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		result = append(result, absAxis{code: code, min: -0x7FF, max: 0x7FF, fuzz: 4, flat: 4})
+	}
+	if o.analogTriggers {
+		result = append(result,
+			absAxis{code: C.ABS_Z, min: 0, max: 255},
+			absAxis{code: C.ABS_RZ, min: 0, max: 255})
+	}
+	if o.hatDPad {
+		result = append(result,
+			absAxis{code: C.ABS_HAT0X, min: -1, max: 1},
+			absAxis{code: C.ABS_HAT0Y, min: -1, max: 1})
+	}
+	return result, nil
+}
+
+// allAxes returns the axes used by the mapping and all of its layers.
+func allAxes(m ControllerMapping) []commonStickMap {
+	result := m.Axes
+	for _, l := range m.Layers {
+		result = append(result[:len(result):len(result)], l.Axes...)
+	}
+	return result
+}
+
+func NewUInput(m ControllerMapping, name string, id DeviceID, remaps jcpc.InputRemappingOptions) (jcpc.Output, error) {
 
 	RemapInputs(&m, remaps)
+	version := layoutVersion(m, remaps)
 
-	o := &uinput{}
+	o := &uinput{
+		activeLayer:    -1,
+		log:            log.With("serials", id.Uniq),
+		effects:        make(map[int]ffEffect),
+		axes:           m.Axes,
+		axisCodes:      linuxKeyMap,
+		analogTriggers: remaps.AnalogTriggers,
+		hatDPad:        remaps.HatDPad,
+	}
+	if o.analogTriggers {
+		// ABS_Z and ABS_RZ are needed for the triggers
+		o.axisCodes = linuxStandardAxisMap
+	}
 
 	fd, err := unix.Open("/dev/uinput", unix.O_RDWR|unix.O_NONBLOCK, 0)
 	if err != nil {
@@ -212,35 +386,62 @@ func NewUInput(m ControllerMapping, name string, remaps jcpc.InputRemappingOptio
 		return nil, errors.Wrap(err, "ioctl uinput_set_eventbit")
 	}
 	err = o.ui_ioctl(C.UI_SET_EVBIT, C.EV_ABS)
-	err = o.ui_ioctl(C.UI_SET_ABSBIT, C.ABS_X)
-	err = o.ui_ioctl(C.UI_SET_ABSBIT, C.ABS_Y)
 	if err != nil {
 		unix.Close(fd)
 		return nil, errors.Wrap(err, "ioctl uinput_set_eventbit")
 	}
+	for _, code := range []uintptr{C.ABS_X, C.ABS_Y} {
+		err = o.ui_ioctl(C.UI_SET_ABSBIT, code)
+		if err != nil {
+			unix.Close(fd)
+			return nil, errors.Wrap(err, "ioctl uinput_set_absbit")
+		}
+	}
 	err = o.ui_ioctl(C.UI_SET_EVBIT, C.EV_KEY)
 	if err != nil {
 		unix.Close(fd)
 		return nil, errors.Wrap(err, "ioctl uinput_set_eventbit")
 	}
-	// TODO
 	err = o.ui_ioctl(C.UI_SET_EVBIT, C.EV_FF)
 	if err != nil {
 		unix.Close(fd)
 		return nil, errors.Wrap(err, "ioctl uinput_set_eventbit")
 	}
+	err = o.ui_ioctl(C.UI_SET_FFBIT, C.FF_RUMBLE)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "ioctl uinput_set_ffbit")
+	}
+	err = o.ui_ioctl(C.UI_SET_EVBIT, C.EV_LED)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "ioctl uinput_set_eventbit")
+	}
+	for _, code := range ledCodes {
+		err = o.ui_ioctl(C.UI_SET_LEDBIT, uintptr(code))
+		if err != nil {
+			unix.Close(fd)
+			return nil, errors.Wrap(err, "ioctl uinput_set_ledbit")
+		}
+	}
+
+	err = o.setIdentity(id)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
 
 	var version_a C.uint
 	err = o.ui_ioctl(C.UI_GET_VERSION, uintptr(unsafe.Pointer(&version_a)))
 	if err == nil && (version_a == 5) {
-		err = o.setupNewKernel(m, name)
+		err = o.setupNewKernel(m, name, id, version)
 	} else {
 		if version_a == 4 {
-			fmt.Println("Using old uinput interface from before kernel 4.5")
+			o.log.Infof("using old uinput interface from before kernel 4.5")
 		} else {
-			fmt.Println("[WARN] Could not determine uinput version, using old interface")
+			o.log.Warnf("could not determine uinput version, using old interface")
 		}
-		err = o.setupOldKernel(m, name)
+		err = o.setupOldKernel(m, name, id, version)
 	}
 	if err != nil {
 		unix.Close(fd)
@@ -248,8 +449,21 @@ func NewUInput(m ControllerMapping, name string, remaps jcpc.InputRemappingOptio
 	}
 
 	o.buttons = commonMappingToInternal(m)
-	for _, code := range o.buttons.KeyCodes {
-		if code == 0 {
+	allCodes := o.buttons.KeyCodes[:]
+	for _, l := range m.Layers {
+		il := internalLayer{
+			shift:   l.Shift.GetIndex(),
+			buttons: keysToInternal(l.Keys),
+			axes:    l.Axes,
+		}
+		if il.shift == -1 {
+			continue
+		}
+		o.layers = append(o.layers, il)
+		allCodes = append(allCodes[:len(allCodes):len(allCodes)], il.buttons.KeyCodes[:]...)
+	}
+	for _, code := range allCodes {
+		if code == 0 || o.isAbsKey(code) {
 			continue
 		}
 
@@ -260,8 +474,6 @@ func NewUInput(m ControllerMapping, name string, remaps jcpc.InputRemappingOptio
 		}
 	}
 
-	// TODO force feedback setup
-
 	err = o.ui_ioctl(C.UI_DEV_CREATE, 0)
 	if err != nil {
 		unix.Close(fd)
@@ -272,7 +484,7 @@ func NewUInput(m ControllerMapping, name string, remaps jcpc.InputRemappingOptio
 		time.Sleep(250 * time.Millisecond)
 		err = o.setPermissions()
 		if err != nil {
-			fmt.Println("[WARN] Failed to set permissions:", err)
+			o.log.Warnf("failed to set permissions: %v", err)
 		}
 	}()
 
@@ -305,7 +517,7 @@ func (o *uinput) setPermissions() error {
 			if err != nil {
 				return errors.Wrap(err, "chmod /dev/input device")
 			}
-			fmt.Println("set permissions for", m)
+			o.log.Debugf("set permissions for %s", m)
 		}
 	}
 
@@ -318,33 +530,180 @@ func (o *uinput) BeginUpdate() error {
 }
 
 func (o *uinput) ButtonUpdate(b jcpc.ButtonID, state bool) {
-	keyCode := o.buttons.KeyCodes[b.GetIndex()]
-	if keyCode == 0 {
+	idx := b.GetIndex()
+	if idx < 0 || idx >= jcpc.NumButtonIndexes {
 		return
 	}
-	val := int32(0)
+
+	for i, l := range o.layers {
+		if l.shift != idx {
+			continue
+		}
+		if state && o.activeLayer == -1 {
+			o.setLayer(i)
+			o.shiftTap = true
+			return
+		} else if !state && o.activeLayer == i {
+			o.setLayer(-1)
+			if o.shiftTap && o.buttons.KeyCodes[idx] != 0 {
+				// Tapped alone - send the normal key, and release it next frame
+				o.keyEvent(o.buttons.KeyCodes[idx], true)
+				o.tapRelease = o.buttons.KeyCodes[idx]
+			}
+			return
+		}
+	}
+
+	var keyCode uint16
 	if state {
-		val = 1
+		o.shiftTap = false
+		keyCode = o.keyCode(idx)
+		o.pressedCodes[idx] = keyCode
+	} else {
+		keyCode = o.pressedCodes[idx]
+		o.pressedCodes[idx] = 0
 	}
-	o.pending = append(o.pending, uinputEvent{
-		Type:  C.EV_KEY,
-		Code:  keyCode,
-		Value: val,
-	})
+	if keyCode == 0 {
+		return
+	}
+	o.keyEvent(keyCode, state)
 }
 
-func (o *uinput) StickUpdate(axis jcpc.AxisID, value int16) {
-	var code uint16
-	var ok bool
-	var invert bool
+// isAbsKey returns true if the key code is reported as an axis instead.
+func (o *uinput) isAbsKey(code uint16) bool {
+	switch code {
+	case C.BTN_TL2, C.BTN_TR2:
+		return o.analogTriggers
+	case C.BTN_DPAD_UP, C.BTN_DPAD_DOWN, C.BTN_DPAD_LEFT, C.BTN_DPAD_RIGHT:
+		return o.hatDPad
+	}
+	return false
+}
+
+// keyEvent queues a key press or release, converting it to a trigger or
+// hat axis if enabled.
+//
+// mu must be held
+func (o *uinput) keyEvent(code uint16, state bool) {
+	if !o.isAbsKey(code) {
+		val := int32(0)
+		if state {
+			val = 1
+		}
+		o.pending = append(o.pending, uinputEvent{
+			Type:  C.EV_KEY,
+			Code:  code,
+			Value: val,
+		})
+		return
+	}
 
+	switch code {
+	case C.BTN_TL2, C.BTN_TR2:
+		ev := uinputEvent{Type: C.EV_ABS, Code: C.ABS_Z}
+		if code == C.BTN_TR2 {
+			ev.Code = C.ABS_RZ
+		}
+		if state {
+			ev.Value = 255
+		}
+		o.pending = append(o.pending, ev)
+		return
+	}
+
+	for i, c := range dpadCodes {
+		if c == code {
+			o.dpad[i] = state
+		}
+	}
+	hat := func(neg, pos bool) int32 {
+		v := int32(0)
+		if neg {
+			v--
+		}
+		if pos {
+			v++
+		}
+		return v
+	}
+	if code == C.BTN_DPAD_LEFT || code == C.BTN_DPAD_RIGHT {
+		o.pending = append(o.pending, uinputEvent{
+			Type:  C.EV_ABS,
+			Code:  C.ABS_HAT0X,
+			Value: hat(o.dpad[2], o.dpad[3]),
+		})
+	} else {
+		o.pending = append(o.pending, uinputEvent{
+			Type:  C.EV_ABS,
+			Code:  C.ABS_HAT0Y,
+			Value: hat(o.dpad[0], o.dpad[1]),
+		})
+	}
+}
+
+// mu must be held
+func (o *uinput) keyCode(idx int) uint16 {
+	if o.activeLayer != -1 {
+		if code := o.layers[o.activeLayer].buttons.KeyCodes[idx]; code != 0 {
+			return code
+		}
+	}
+	return o.buttons.KeyCodes[idx]
+}
+
+// mu must be held
+func (o *uinput) axisMapping(axis jcpc.AxisID) (code uint16, invert bool, ok bool) {
+	if o.activeLayer != -1 {
+		for _, e := range o.layers[o.activeLayer].axes {
+			if e.Axis == axis {
+				code, ok = o.axisCodes[e.Name]
+				return code, e.Invert, ok
+			}
+		}
+	}
 	for _, e := range o.axes {
 		if e.Axis == axis {
-			code, ok = linuxKeyMap[e.Name]
-			invert = e.Invert
-			break
+			code, ok = o.axisCodes[e.Name]
+			return code, e.Invert, ok
+		}
+	}
+	return 0, false, false
+}
+
+// Switch to a different shift layer.  Sticks that move to a different axis
+// are re-centered on the old axis.
+//
+// mu must be held
+func (o *uinput) setLayer(layer int) {
+	var prevCodes [4]uint16
+	for i := range o.stickValues {
+		prevCodes[i], _, _ = o.axisMapping(jcpc.AxisID(i))
+	}
+	o.activeLayer = layer
+	for i := range o.stickValues {
+		code, _, ok := o.axisMapping(jcpc.AxisID(i))
+		if ok && code == prevCodes[i] {
+			continue
+		}
+		if prevCodes[i] != 0 {
+			o.pending = append(o.pending, uinputEvent{
+				Type:  C.EV_ABS,
+				Code:  prevCodes[i],
+				Value: 0,
+			})
 		}
+		o.StickUpdate(jcpc.AxisID(i), o.stickValues[i])
+	}
+}
+
+func (o *uinput) StickUpdate(axis jcpc.AxisID, value int16) {
+	if axis < 0 {
+		return
+	}
+	if int(axis) < len(o.stickValues) {
+		o.stickValues[axis] = value
 	}
+	code, invert, ok := o.axisMapping(axis)
 	if !ok {
 		return
 	}
@@ -365,6 +724,11 @@ func (o *uinput) GyroUpdate(vals jcpc.GyroFrame) {}
 func (o *uinput) FlushUpdate() error {
 	defer o.mu.Unlock()
 
+	return o.flush()
+}
+
+// mu must be held
+func (o *uinput) flush() error {
 	if len(o.pending) == 0 {
 		return nil
 	}
@@ -380,13 +744,112 @@ func (o *uinput) FlushUpdate() error {
 	evSync.EncodeTo(buf[len(o.pending)*C.sizeof_struct_input_event:])
 	n, err := unix.Write(o.fd, buf)
 	if n != len(buf) {
-		fmt.Println("[!!] short uinput write", n)
+		o.log.Warnf("short uinput write %d", n)
 	}
 	o.pending = o.pending[:0]
 	return err
 }
 
-func (o *uinput) OnFrame() {}
+func (o *uinput) OnFrame() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.tapRelease != 0 {
+		o.keyEvent(o.tapRelease, false)
+		o.tapRelease = 0
+		o.flush()
+	}
+	o.readEvents()
+}
+
+func (o *uinput) BindFeedback(r jcpc.Rumbler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.rumbler = r
+}
+
+func (o *uinput) BindLights(l jcpc.LightSetter) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.lights = l
+}
+
+// readEvents handles the events sent to the device, which are force
+// feedback requests and LED changes.
+//
+// mu must be held
+func (o *uinput) readEvents() {
+	var buf [16 * C.sizeof_struct_input_event]byte
+	for {
+		n, err := unix.Read(o.fd, buf[:])
+		if err != nil || n <= 0 {
+			// EAGAIN when there are no more events
+			return
+		}
+		for p := buf[:n]; len(p) >= C.sizeof_struct_input_event; p = p[C.sizeof_struct_input_event:] {
+			o.handleEvent(decodeUinputEvent(p))
+		}
+	}
+}
+
+// mu must be held
+func (o *uinput) handleEvent(ev uinputEvent) {
+	switch ev.Type {
+	case C.EV_UINPUT:
+		switch ev.Code {
+		case C.UI_FF_UPLOAD:
+			var strong, weak, length C.ushort
+			id := C.ff_upload(C.int(o.fd), C.uint(ev.Value), &strong, &weak, &length)
+			if id >= 0 {
+				o.effects[int(id)] = ffEffect{uint16(strong), uint16(weak), uint16(length)}
+			}
+		case C.UI_FF_ERASE:
+			id := C.ff_erase(C.int(o.fd), C.uint(ev.Value))
+			if id >= 0 {
+				delete(o.effects, int(id))
+			}
+		}
+	case C.EV_FF:
+		e, ok := o.effects[int(ev.Code)]
+		if !ok || o.rumbler == nil || ev.Value == 0 {
+			return
+		}
+		frames := int(e.lengthMs) * 60 / 1000
+		if frames <= 0 || frames > ffMaxFrames {
+			frames = ffMaxFrames
+		}
+		o.rumbler.Rumble([]jcpc.RumbleData{jcpc.RumbleFromMagnitude(e.strong, e.weak, frames)})
+	case C.EV_LED:
+		for i, code := range ledCodes {
+			if code == ev.Code && o.leds[i] != (ev.Value != 0) {
+				o.leds[i] = ev.Value != 0
+				o.updateLights()
+			}
+		}
+	}
+}
+
+// updateLights sends the LED state to the player lights.
+//
+// mu must be held
+func (o *uinput) updateLights() {
+	if o.lights == nil {
+		return
+	}
+	var pattern byte
+	for i := 0; i < 4; i++ {
+		if o.leds[i] {
+			pattern |= 1 << uint(i)
+		}
+	}
+	if o.leds[4] {
+		// flash instead of staying on
+		pattern <<= 4
+	}
+	o.lights.SetLights(pattern)
+}
 
 func (o *uinput) Close() error {
 	o.mu.Lock()
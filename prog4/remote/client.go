@@ -0,0 +1,395 @@
+package remote
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// Delays between reconnect attempts.
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Client connects to a Server and sends it the input of local controllers.
+// Use Factory to create its outputs.
+type Client struct {
+	addr    string
+	key     []byte
+	session string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// messages for writeLoop, nil while disconnected
+	queue   chan message
+	devices map[int]*remoteOutput
+	nextID  int
+	closed  bool
+}
+
+func NewClient(addr string, key []byte) *Client {
+	var session [16]byte
+	rand.Read(session[:])
+	return &Client{
+		addr:    addr,
+		key:     key,
+		session: hex.EncodeToString(session[:]),
+		devices: make(map[int]*remoteOutput),
+		nextID:  1,
+	}
+}
+
+// Run keeps the connection to the server up until Close is called.
+func (c *Client) Run() {
+	delay := minReconnectDelay
+	for {
+		dec, err := c.connect()
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			log.Warnf("could not connect to %s: %v (retrying in %v)", c.addr, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = minReconnectDelay
+		log.Infof("connected to %s", c.addr)
+
+		err = c.readLoop(dec)
+		c.mu.Lock()
+		c.conn.Close()
+		c.conn = nil
+		close(c.queue)
+		c.queue = nil
+		c.mu.Unlock()
+		if c.isClosed() {
+			return
+		}
+		log.Warnf("lost connection: %v", err)
+	}
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// connect dials the server, performs the handshake and re-opens existing
+// devices.
+func (c *Client) connect() (*json.Decoder, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+
+	var hello message
+	err = dec.Decode(&hello)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "reading hello")
+	}
+	if hello.Type != msgHello || hello.Version != ProtocolVersion {
+		conn.Close()
+		return nil, errors.Errorf("server speaks protocol version %d, want %d", hello.Version, ProtocolVersion)
+	}
+	auth := message{
+		Type:    msgAuth,
+		Version: ProtocolVersion,
+		Session: c.session,
+	}
+	if c.key != nil {
+		auth.Response = authResponse(c.key, hello.Challenge)
+	}
+	err = enc.Encode(&auth)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply message
+	err = dec.Decode(&reply)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "reading handshake reply")
+	}
+	if reply.Type != msgWelcome {
+		conn.Close()
+		return nil, errors.Errorf("server refused connection: %s", reply.Error)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, errors.Errorf("client closed")
+	}
+	c.conn = conn
+	c.queue = make(chan message, sendQueueSize)
+	go writeLoop(conn, enc, c.queue)
+	for _, d := range c.devices {
+		c.send(d.openMessage())
+		c.send(d.stateMessage())
+	}
+	return dec, nil
+}
+
+func (c *Client) readLoop(dec *json.Decoder) error {
+	for {
+		var msg message
+		err := dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case msgRumble:
+			c.mu.Lock()
+			d := c.devices[msg.Device]
+			c.mu.Unlock()
+			if d != nil {
+				d.rumble(msg.Rumble)
+			}
+		case msgLights:
+			c.mu.Lock()
+			d := c.devices[msg.Device]
+			c.mu.Unlock()
+			if d != nil && msg.Lights != nil {
+				d.setLights(*msg.Lights)
+			}
+		case msgError:
+			log.Warnf("server error: %s", msg.Error)
+		}
+	}
+}
+
+// writeLoop writes the messages of a connection until its queue is closed,
+// so that send does not block on the network.
+func writeLoop(conn net.Conn, enc *json.Encoder, queue chan message) {
+	failed := false
+	for msg := range queue {
+		if failed {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := enc.Encode(&msg)
+		if err != nil {
+			// readLoop will notice and reconnect
+			conn.Close()
+			failed = true
+		}
+	}
+}
+
+// send queues a message if connected.  Messages are dropped while
+// disconnected; devices send their full state after reconnecting.
+//
+// mu must be held
+func (c *Client) send(msg message) {
+	if c.queue == nil {
+		return
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		log.Warnf("server is not keeping up, reconnecting")
+		// readLoop will notice and reconnect
+		c.conn.Close()
+	}
+}
+
+// Factory returns an OutputFactory that creates devices on the server.
+func (c *Client) Factory() jcpc.OutputFactory {
+	return func(t jcpc.JoyConType, playerNum int, serials []string, remap jcpc.InputRemappingOptions) (jcpc.Output, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		d := &remoteOutput{
+			client:  c,
+			id:      c.nextID,
+			t:       t,
+			pNum:    playerNum,
+			serials: serials,
+			remap:   remap,
+			buttons: make(map[jcpc.ButtonID]bool),
+			sticks:  make(map[jcpc.AxisID]int16),
+		}
+		c.nextID++
+		c.devices[d.id] = d
+		c.send(d.openMessage())
+		return d, nil
+	}
+}
+
+// remoteOutput is the client side of a device on the server.
+type remoteOutput struct {
+	client  *Client
+	id      int
+	t       jcpc.JoyConType
+	pNum    int
+	serials []string
+	remap   jcpc.InputRemappingOptions
+
+	// Locked by BeginUpdate, unlocked by FlushUpdate
+	mu      sync.Mutex
+	pending message
+
+	// current state, sent after a reconnect
+	stateMu sync.Mutex
+	buttons map[jcpc.ButtonID]bool
+	sticks  map[jcpc.AxisID]int16
+
+	feedbackMu sync.Mutex
+	rumbler    jcpc.Rumbler
+	lights     jcpc.LightSetter
+	// lights received from the server, delivered on the next frame
+	newLights *byte
+}
+
+var _ jcpc.Output = &remoteOutput{}
+var _ jcpc.FeedbackOutput = &remoteOutput{}
+var _ jcpc.LightsOutput = &remoteOutput{}
+
+// client.mu must be held
+func (d *remoteOutput) openMessage() message {
+	remap := d.remap
+	return message{
+		Type:       msgOpen,
+		Device:     d.id,
+		JoyConType: d.t,
+		Player:     d.pNum,
+		Serials:    d.serials,
+		Remap:      &remap,
+	}
+}
+
+// client.mu must be held
+func (d *remoteOutput) stateMessage() message {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	msg := message{Type: msgUpdate, Device: d.id}
+	for b, v := range d.buttons {
+		msg.Buttons = append(msg.Buttons, buttonEvent{b, v})
+	}
+	for a, v := range d.sticks {
+		msg.Sticks = append(msg.Sticks, stickEvent{a, v})
+	}
+	return msg
+}
+
+func (d *remoteOutput) BeginUpdate() error {
+	d.mu.Lock()
+	d.pending = message{Type: msgUpdate, Device: d.id}
+	return nil
+}
+
+func (d *remoteOutput) ButtonUpdate(b jcpc.ButtonID, value bool) {
+	d.stateMu.Lock()
+	d.buttons[b] = value
+	d.stateMu.Unlock()
+	d.pending.Buttons = append(d.pending.Buttons, buttonEvent{b, value})
+}
+
+func (d *remoteOutput) StickUpdate(axis jcpc.AxisID, value int16) {
+	d.stateMu.Lock()
+	d.sticks[axis] = value
+	d.stateMu.Unlock()
+	d.pending.Sticks = append(d.pending.Sticks, stickEvent{axis, value})
+}
+
+func (d *remoteOutput) GyroUpdate(vals jcpc.GyroFrame) {
+	d.pending.Gyro = append(d.pending.Gyro, vals)
+}
+
+func (d *remoteOutput) FlushUpdate() error {
+	defer d.mu.Unlock()
+
+	msg := d.pending
+	if msg.Buttons == nil && msg.Sticks == nil && msg.Gyro == nil {
+		return nil
+	}
+	d.client.mu.Lock()
+	defer d.client.mu.Unlock()
+
+	d.client.send(msg)
+	return nil
+}
+
+func (d *remoteOutput) OnFrame() {
+	d.feedbackMu.Lock()
+	l, pattern := d.lights, d.newLights
+	d.newLights = nil
+	d.feedbackMu.Unlock()
+
+	if l != nil && pattern != nil {
+		l.SetLights(*pattern)
+	}
+}
+
+func (d *remoteOutput) BindFeedback(r jcpc.Rumbler) {
+	d.feedbackMu.Lock()
+	defer d.feedbackMu.Unlock()
+
+	d.rumbler = r
+}
+
+func (d *remoteOutput) BindLights(l jcpc.LightSetter) {
+	d.feedbackMu.Lock()
+	defer d.feedbackMu.Unlock()
+
+	d.lights = l
+}
+
+func (d *remoteOutput) setLights(pattern byte) {
+	d.feedbackMu.Lock()
+	defer d.feedbackMu.Unlock()
+
+	d.newLights = &pattern
+}
+
+func (d *remoteOutput) rumble(data []jcpc.RumbleData) {
+	d.feedbackMu.Lock()
+	r := d.rumbler
+	d.feedbackMu.Unlock()
+
+	if r != nil && len(data) > 0 {
+		r.Rumble(data)
+	}
+}
+
+func (d *remoteOutput) Close() error {
+	c := d.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.devices, d.id)
+	c.send(message{Type: msgClose, Device: d.id})
+	return nil
+}
@@ -0,0 +1,102 @@
+// Package remote shares controllers over TCP.  The client runs next to the
+// Joy-Cons and uses a network Output in place of uinput; the server creates
+// the real output devices and sends force feedback back as rumble.
+//
+// The wire protocol is newline-delimited JSON messages (see message).  A
+// connection starts with a handshake:
+//
+//	server: {"type":"hello","version":1,"challenge":"..."}
+//	client: {"type":"auth","version":1,"session":"...","response":"..."}
+//	server: {"type":"welcome"} or {"type":"error","error":"..."}
+//
+// The response is the HMAC-SHA256 of the challenge, keyed with the
+// pre-shared key, and is checked only if the server has a key.  The session
+// is chosen by the client and lets it take over its devices when it
+// reconnects.
+//
+// After the handshake the client sends "open", "update" and "close" for
+// each device, and the server sends "rumble" and "lights".
+package remote
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+
+	"github.com/riking/joycon/prog4/jclog"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+var log = jclog.New("remote")
+
+// ProtocolVersion is increased for incompatible changes.
+const ProtocolVersion = 1
+
+const (
+	msgHello   = "hello"
+	msgAuth    = "auth"
+	msgWelcome = "welcome"
+	msgError   = "error"
+	msgOpen    = "open"
+	msgUpdate  = "update"
+	msgClose   = "close"
+	msgRumble  = "rumble"
+	msgLights  = "lights"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	writeTimeout     = 2 * time.Second
+	// Messages waiting to be written by a client.  A client whose
+	// connection falls this far behind reconnects.
+	sendQueueSize = 256
+	// How long the server keeps the devices of a disconnected client.
+	sessionTimeout = 30 * time.Second
+)
+
+type message struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// handshake
+	Challenge []byte `json:"challenge,omitempty"`
+	Response  []byte `json:"response,omitempty"`
+	Session   string `json:"session,omitempty"`
+
+	// Chosen by the client, unique within the session
+	Device int `json:"device,omitempty"`
+
+	// open
+	JoyConType jcpc.JoyConType             `json:"joycon_type,omitempty"`
+	Player     int                         `json:"player,omitempty"`
+	Serials    []string                    `json:"serials,omitempty"`
+	Remap      *jcpc.InputRemappingOptions `json:"remap,omitempty"`
+
+	// update
+	Buttons []buttonEvent    `json:"buttons,omitempty"`
+	Sticks  []stickEvent     `json:"sticks,omitempty"`
+	Gyro    []jcpc.GyroFrame `json:"gyro,omitempty"`
+
+	// rumble
+	Rumble []jcpc.RumbleData `json:"rumble,omitempty"`
+
+	// lights, see jcpc.LightSetter
+	Lights *byte `json:"lights,omitempty"`
+}
+
+type buttonEvent struct {
+	Button  jcpc.ButtonID `json:"b"`
+	Pressed bool          `json:"v"`
+}
+
+type stickEvent struct {
+	Axis  jcpc.AxisID `json:"a"`
+	Value int16       `json:"v"`
+}
+
+func authResponse(key, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
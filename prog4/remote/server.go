@@ -0,0 +1,394 @@
+package remote
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// Server accepts connections from Clients and creates their devices with an
+// OutputFactory.
+type Server struct {
+	listener net.Listener
+	factory  jcpc.OutputFactory
+	key      []byte
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// A session holds the devices of one client, across reconnects.
+type session struct {
+	id string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// messages for writeLoop, nil while disconnected
+	queue   chan message
+	devices map[int]*serverDevice
+	// closes the devices after the client has been gone for a while
+	expire *time.Timer
+}
+
+type serverDevice struct {
+	s   *session
+	id  int
+	out jcpc.Output
+
+	// state on the output, released when the client disconnects
+	buttons map[jcpc.ButtonID]bool
+	sticks  map[jcpc.AxisID]int16
+}
+
+// NewServer listens on addr.  If key is not nil, clients must know it.
+func NewServer(addr string, factory jcpc.OutputFactory, key []byte) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "remote: listen")
+	}
+	return &Server{
+		listener: l,
+		factory:  factory,
+		key:      key,
+		sessions: make(map[string]*session),
+	}, nil
+}
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() error {
+	frameTicker := time.NewTicker(16666 * time.Microsecond)
+	defer frameTicker.Stop()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-frameTicker.C:
+				s.onFrame()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		sess.close()
+		delete(s.sessions, id)
+	}
+	return err
+}
+
+func (s *Server) onFrame() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		for _, d := range sess.devices {
+			d.out.OnFrame()
+		}
+		sess.mu.Unlock()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	queue := make(chan message, sendQueueSize)
+	go writeLoop(conn, enc, queue)
+	// after detach, the session no longer sends to queue
+	defer close(queue)
+	sess, err := s.handshake(conn, dec, enc, queue)
+	if err != nil {
+		log.Warnf("handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Infof("client connected from %s", conn.RemoteAddr())
+
+	for {
+		var msg message
+		err = dec.Decode(&msg)
+		if err != nil {
+			break
+		}
+		err = sess.handleMessage(s.factory, msg)
+		if err != nil {
+			sess.mu.Lock()
+			sess.send(message{Type: msgError, Device: msg.Device, Error: err.Error()})
+			sess.mu.Unlock()
+		}
+	}
+
+	log.Infof("client disconnected: %s %v", conn.RemoteAddr(), err)
+	s.detach(sess, conn)
+}
+
+// handshake authenticates the client.  Until it is attached to a session, it
+// writes to the connection directly.
+func (s *Server) handshake(conn net.Conn, dec *json.Decoder, enc *json.Encoder, queue chan message) (*session, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	err := enc.Encode(&message{Type: msgHello, Version: ProtocolVersion, Challenge: challenge})
+	if err != nil {
+		return nil, err
+	}
+
+	var auth message
+	err = dec.Decode(&auth)
+	if err != nil {
+		return nil, err
+	}
+	refuse := func(reason string) (*session, error) {
+		enc.Encode(&message{Type: msgError, Error: reason})
+		return nil, errors.New(reason)
+	}
+	if auth.Type != msgAuth {
+		return refuse("expected auth message")
+	}
+	if auth.Version != ProtocolVersion {
+		return refuse(fmt.Sprintf("unsupported protocol version %d, want %d", auth.Version, ProtocolVersion))
+	}
+	if s.key != nil && !hmac.Equal(auth.Response, authResponse(s.key, challenge)) {
+		return refuse("wrong key")
+	}
+	if auth.Session == "" {
+		return refuse("missing session")
+	}
+
+	sess := s.attach(auth.Session, conn, queue)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.send(message{Type: msgWelcome})
+	return sess, nil
+}
+
+// attach finds or creates a session and makes conn its connection.
+func (s *Server) attach(id string, conn net.Conn, queue chan message) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		sess = &session{
+			id:      id,
+			devices: make(map[int]*serverDevice),
+		}
+		s.sessions[id] = sess
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.expire != nil {
+		sess.expire.Stop()
+		sess.expire = nil
+	}
+	if sess.conn != nil {
+		// replaced by a newer connection
+		sess.conn.Close()
+	}
+	sess.conn = conn
+	sess.queue = queue
+	return sess
+}
+
+// detach releases the session's devices after the connection ends.  The
+// devices are kept for a while so that the client can reconnect.
+func (s *Server) detach(sess *session, conn net.Conn) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.conn != conn {
+		return
+	}
+	sess.conn = nil
+	sess.queue = nil
+	for _, d := range sess.devices {
+		d.release()
+	}
+	sess.expire = time.AfterFunc(sessionTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		sess.mu.Lock()
+		reconnected := sess.conn != nil
+		sess.mu.Unlock()
+		if reconnected || s.sessions[sess.id] != sess {
+			return
+		}
+		delete(s.sessions, sess.id)
+		sess.close()
+	})
+}
+
+func (sess *session) close() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.conn != nil {
+		sess.conn.Close()
+	}
+	for id, d := range sess.devices {
+		d.out.Close()
+		delete(sess.devices, id)
+	}
+}
+
+// send queues a message if the client is connected.  A client that does not
+// keep up is disconnected, releasing its devices until it reconnects.
+//
+// mu must be held
+func (sess *session) send(msg message) {
+	if sess.queue == nil {
+		return
+	}
+	select {
+	case sess.queue <- msg:
+	default:
+		log.Warnf("client %s is not keeping up, disconnecting", sess.conn.RemoteAddr())
+		// handleConn will notice and detach
+		sess.conn.Close()
+	}
+}
+
+func (sess *session) handleMessage(factory jcpc.OutputFactory, msg message) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	switch msg.Type {
+	case msgOpen:
+		if _, ok := sess.devices[msg.Device]; ok {
+			// reconnected, keep using the existing device
+			return nil
+		}
+		switch msg.JoyConType {
+		case jcpc.TypeLeft, jcpc.TypeRight, jcpc.TypeBoth, jcpc.TypePro:
+		default:
+			return errors.Errorf("invalid joycon type %d", msg.JoyConType)
+		}
+		var remap jcpc.InputRemappingOptions
+		if msg.Remap != nil {
+			remap = *msg.Remap
+		}
+		out, err := factory(msg.JoyConType, msg.Player, msg.Serials, remap)
+		if err != nil {
+			return errors.Wrap(err, "creating output")
+		}
+		d := &serverDevice{
+			s:       sess,
+			id:      msg.Device,
+			out:     out,
+			buttons: make(map[jcpc.ButtonID]bool),
+			sticks:  make(map[jcpc.AxisID]int16),
+		}
+		sess.devices[msg.Device] = d
+		if fo, ok := out.(jcpc.FeedbackOutput); ok {
+			fo.BindFeedback(d)
+		}
+		if lo, ok := out.(jcpc.LightsOutput); ok {
+			lo.BindLights(d)
+		}
+	case msgUpdate:
+		d, ok := sess.devices[msg.Device]
+		if !ok {
+			return errors.Errorf("no device %d", msg.Device)
+		}
+		for _, ev := range msg.Buttons {
+			if idx := ev.Button.GetIndex(); idx < 0 || idx >= jcpc.NumButtonIndexes {
+				return errors.Errorf("invalid button %#x", uint16(ev.Button))
+			}
+		}
+		for _, ev := range msg.Sticks {
+			if ev.Axis < jcpc.Axis_L_Horiz || ev.Axis >= jcpc.Axis_Orientation_Min {
+				return errors.Errorf("invalid axis %d", ev.Axis)
+			}
+		}
+		return d.update(msg)
+	case msgClose:
+		d, ok := sess.devices[msg.Device]
+		if !ok {
+			return nil
+		}
+		delete(sess.devices, msg.Device)
+		return d.out.Close()
+	default:
+		return errors.Errorf("unknown message type '%s'", msg.Type)
+	}
+	return nil
+}
+
+// session.mu must be held
+func (d *serverDevice) update(msg message) error {
+	d.out.BeginUpdate()
+	for _, ev := range msg.Buttons {
+		d.out.ButtonUpdate(ev.Button, ev.Pressed)
+		d.buttons[ev.Button] = ev.Pressed
+	}
+	for _, ev := range msg.Sticks {
+		d.out.StickUpdate(ev.Axis, ev.Value)
+		d.sticks[ev.Axis] = ev.Value
+	}
+	for _, g := range msg.Gyro {
+		d.out.GyroUpdate(g)
+	}
+	return d.out.FlushUpdate()
+}
+
+// release lets go of all buttons and centers the sticks.
+//
+// session.mu must be held
+func (d *serverDevice) release() {
+	msg := message{Type: msgUpdate}
+	for b, v := range d.buttons {
+		if v {
+			msg.Buttons = append(msg.Buttons, buttonEvent{b, false})
+		}
+	}
+	for a, v := range d.sticks {
+		if v != 0 {
+			msg.Sticks = append(msg.Sticks, stickEvent{a, 0})
+		}
+	}
+	d.update(msg)
+}
+
+// Rumble sends force feedback from the output to the client.
+func (d *serverDevice) Rumble(data []jcpc.RumbleData) {
+	// Called from the output, which is only used with session.mu held
+	d.s.send(message{Type: msgRumble, Device: d.id, Rumble: data})
+}
+
+// SetLights sends the player lights set on the output to the client.
+func (d *serverDevice) SetLights(pattern byte) {
+	// Called from OnFrame, with session.mu held
+	d.s.send(message{Type: msgLights, Device: d.id, Lights: &pattern})
+}
@@ -0,0 +1,135 @@
+package webiface
+
+import (
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+// Event types sent to clients.
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventButton     = "button"
+	EventStick      = "stick"
+	EventIMU        = "imu"
+	EventBattery    = "battery"
+	EventError      = "error"
+)
+
+// Command types accepted from clients.
+const (
+	CommandRumble = "rumble"
+	CommandLights = "lights"
+	CommandIMU    = "imu"
+)
+
+// Event is a message sent to clients.  Only the fields relevant to the Type
+// are present.
+type Event struct {
+	Type   string `json:"type"`
+	Player int    `json:"player,omitempty"`
+	Serial string `json:"serial,omitempty"`
+
+	// connect
+	JoyCons []JoyConInfo `json:"joycons,omitempty"`
+	// button
+	Button  string `json:"button,omitempty"`
+	Pressed *bool  `json:"pressed,omitempty"`
+	// stick, range -2047 to 2047
+	Axis  string `json:"axis,omitempty"`
+	Value *int16 `json:"value,omitempty"`
+	// imu: 3 frames of accelerometer X/Y/Z then gyroscope X/Y/Z
+	IMU *[3]jcpc.GyroFrame `json:"imu,omitempty"`
+	// battery: 4=full to 0=empty
+	Level    *int8 `json:"level,omitempty"`
+	Charging bool  `json:"charging,omitempty"`
+	// error
+	Error string `json:"error,omitempty"`
+}
+
+type JoyConInfo struct {
+	Serial string `json:"serial"`
+	Type   string `json:"type"`
+}
+
+// Command is a message from a client.  It applies to the JoyCon with the
+// given Serial, or to all JoyCons of Player.
+type Command struct {
+	Type   string `json:"type"`
+	Player int    `json:"player"`
+	Serial string `json:"serial"`
+
+	// rumble
+	Rumble []jcpc.RumbleData `json:"rumble"`
+	// lights of the whole controller, see jcpc.SetPlayerLights.  0 gives
+	// them back to the driver.
+	Pattern byte `json:"pattern"`
+	// imu
+	Enabled bool `json:"enabled"`
+}
+
+var stickNames = []string{"LH", "LV", "RH", "RV"}
+
+func connectEvent(pNum int, jcs []jcpc.JoyCon) Event {
+	ev := Event{Type: EventConnect, Player: pNum}
+	for _, jc := range jcs {
+		ev.JoyCons = append(ev.JoyCons, JoyConInfo{
+			Serial: jc.Serial(),
+			Type:   jc.Type().String(),
+		})
+	}
+	return ev
+}
+
+func errorEvent(err error) Event {
+	return Event{Type: EventError, Error: err.Error()}
+}
+
+func (s *Server) handleCommand(cmd Command) error {
+	if cmd.Type == CommandLights {
+		return s.setLights(cmd)
+	}
+
+	var jcs []jcpc.JoyCon
+	if cmd.Serial != "" {
+		jc := s.findJoyCon(cmd.Serial)
+		if jc == nil {
+			return errors.Errorf("no paired JoyCon with serial %s", cmd.Serial)
+		}
+		jcs = []jcpc.JoyCon{jc}
+	} else {
+		jcs = s.playerJoyCons(cmd.Player)
+		if jcs == nil {
+			return errors.Errorf("no controller for player %d", cmd.Player)
+		}
+	}
+
+	switch cmd.Type {
+	case CommandRumble:
+		if len(cmd.Rumble) == 0 {
+			return errors.Errorf("rumble: no data")
+		}
+		for _, jc := range jcs {
+			jc.Rumble(cmd.Rumble)
+		}
+	case CommandIMU:
+		for _, jc := range jcs {
+			jc.EnableGyro(cmd.Enabled)
+		}
+	default:
+		return errors.Errorf("unknown command type '%s'", cmd.Type)
+	}
+	return nil
+}
+
+// setLights sets the player lights of the controller of a player or JoyCon.
+func (s *Server) setLights(cmd Command) error {
+	pNum := cmd.Player
+	if cmd.Serial != "" {
+		pNum = s.findPlayer(cmd.Serial)
+		if pNum == 0 {
+			return errors.Errorf("no paired JoyCon with serial %s", cmd.Serial)
+		}
+	}
+	return s.lights.SetHostLights(pNum, cmd.Pattern)
+}
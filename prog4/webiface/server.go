@@ -0,0 +1,349 @@
+// Package webiface serves a live feed of controller state as JSON over a
+// WebSocket, for building browser-based tools on top of the driver.
+//
+// Connect to ws://<address>/ws.  Every message is a JSON object with a
+// "type" field, see Event.  Clients can send "rumble", "lights" and "imu"
+// messages, see Command.
+package webiface
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/riking/joycon/prog4/jclog"
+	"github.com/riking/joycon/prog4/jcpc"
+)
+
+var log = jclog.New("webiface")
+
+// DefaultAddress is the suggested address to listen on.
+const DefaultAddress = "127.0.0.1:8090"
+
+// Events waiting to be written to a client.  Clients that fall this far
+// behind are disconnected.
+const clientQueueSize = 256
+
+type player struct {
+	jcs   []jcpc.JoyCon
+	state jcpc.CombinedState
+}
+
+type client struct {
+	conn  *websocket.Conn
+	queue chan []byte
+}
+
+// HostLights sets the player lights of a controller the way a game does
+// through its output, so that they are not replaced by the player number.
+// consoleiface.Manager implements it.
+type HostLights interface {
+	SetHostLights(pNum int, pattern byte) error
+}
+
+// Server streams the state of paired controllers to WebSocket clients.
+//
+// Server implements jcpc.Watcher and must be added to the Manager with
+// AddWatcher.
+type Server struct {
+	listener net.Listener
+	upgrader websocket.Upgrader
+	lights   HostLights
+
+	mu      sync.Mutex
+	closed  bool
+	players map[int]*player
+	clients map[*client]struct{}
+}
+
+var _ jcpc.Watcher = (*Server)(nil)
+
+func NewServer(addr string, lights HostLights) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "webiface: listen")
+	}
+	s := &Server{
+		listener: l,
+		lights:   lights,
+		players:  make(map[int]*player),
+		clients:  make(map[*client]struct{}),
+	}
+	s.upgrader.CheckOrigin = checkOrigin
+	return s, nil
+}
+
+// checkOrigin only allows pages served from the local machine, so that
+// random websites can't rumble the controllers.  Browsers always send an
+// Origin, so requests without one come from other programs.  "null" is sent
+// by sandboxed iframes and data: pages, which any website can create.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve handles HTTP requests until the server is closed.
+func (s *Server) Serve() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	return http.Serve(s.listener, mux)
+}
+
+// Close stops listening and disconnects all clients.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c := range s.clients {
+		delete(s.clients, c)
+		close(c.queue)
+		// stops readLoop
+		c.conn.Close()
+	}
+	return err
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		return
+	}
+	c := &client{
+		conn:  conn,
+		queue: make(chan []byte, clientQueueSize),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients[c] = struct{}{}
+	// Tell the new client about the current controllers
+	for pNum, p := range s.players {
+		s.sendTo(c, connectEvent(pNum, p.jcs))
+	}
+	s.mu.Unlock()
+
+	go s.writeLoop(c)
+	s.readLoop(c)
+}
+
+func (s *Server) writeLoop(c *client) {
+	for msg := range c.queue {
+		err := c.conn.WriteMessage(websocket.TextMessage, msg)
+		if err != nil {
+			break
+		}
+	}
+	c.conn.Close()
+}
+
+func (s *Server) readLoop(c *client) {
+	defer s.removeClient(c)
+
+	for {
+		var cmd Command
+		err := c.conn.ReadJSON(&cmd)
+		if err != nil {
+			switch err.(type) {
+			case *json.UnmarshalTypeError, *json.SyntaxError:
+				s.reply(c, errorEvent(err))
+				continue
+			}
+			return
+		}
+		err = s.handleCommand(cmd)
+		if err != nil {
+			s.reply(c, errorEvent(err))
+		}
+	}
+}
+
+func (s *Server) removeClient(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.queue)
+	}
+}
+
+func (s *Server) reply(c *client, ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendTo(c, ev)
+}
+
+// mu must be held
+func (s *Server) sendTo(c *client, ev Event) {
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		log.Warnf("encoding event: %v", err)
+		return
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		// too slow, drop it
+		delete(s.clients, c)
+		close(c.queue)
+	}
+}
+
+// mu must be held
+func (s *Server) broadcast(ev Event) {
+	for c := range s.clients {
+		s.sendTo(c, ev)
+	}
+}
+
+// findJoyCon looks up a JoyCon of a paired controller by serial number.
+func (s *Server) findJoyCon(serial string) jcpc.JoyCon {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.players {
+		for _, jc := range p.jcs {
+			if jc.Serial() == serial {
+				return jc
+			}
+		}
+	}
+	return nil
+}
+
+// findPlayer returns the player number of a JoyCon, or 0.
+func (s *Server) findPlayer(serial string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for pNum, p := range s.players {
+		for _, jc := range p.jcs {
+			if jc.Serial() == serial {
+				return pNum
+			}
+		}
+	}
+	return 0
+}
+
+// playerJoyCons returns the JoyCons of a player.
+func (s *Server) playerJoyCons(pNum int) []jcpc.JoyCon {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.players[pNum]; ok {
+		return p.jcs
+	}
+	return nil
+}
+
+func (s *Server) WatchController(pNum int, jcs []jcpc.JoyCon) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if jcs == nil {
+		delete(s.players, pNum)
+		s.broadcast(Event{Type: EventDisconnect, Player: pNum})
+		return
+	}
+	p := &player{jcs: jcs}
+	for _, jc := range jcs {
+		jc.ReadInto(&p.state, false)
+	}
+	s.players[pNum] = p
+	s.broadcast(connectEvent(pNum, jcs))
+}
+
+func (s *Server) WatchUpdate(pNum int, jc jcpc.JoyCon, flags int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.players[pNum]
+	if !ok {
+		return
+	}
+
+	if flags&jcpc.NotifyBattery != 0 {
+		level, charging := jc.Battery()
+		s.broadcast(Event{
+			Type:     EventBattery,
+			Player:   pNum,
+			Serial:   jc.Serial(),
+			Level:    &level,
+			Charging: charging,
+		})
+	}
+
+	if flags&jcpc.NotifyInput == 0 {
+		return
+	}
+	prev := p.state
+	jc.ReadInto(&p.state, false)
+
+	diff := p.state.Buttons.DiffMask(prev.Buttons)
+	for _, b := range jcpc.ButtonList {
+		if !diff.Get(b) {
+			continue
+		}
+		pressed := p.state.Buttons.Get(b)
+		s.broadcast(Event{
+			Type:    EventButton,
+			Player:  pNum,
+			Button:  b.String(),
+			Pressed: &pressed,
+		})
+	}
+	for i, name := range stickNames {
+		side, axis := i/2, i%2
+		v := p.state.AdjSticks[side][axis]
+		if v == prev.AdjSticks[side][axis] {
+			continue
+		}
+		s.broadcast(Event{
+			Type:   EventStick,
+			Player: pNum,
+			Axis:   name,
+			Value:  &v,
+		})
+	}
+
+	// IMU data is per JoyCon, and only present once enabled
+	var imu jcpc.CombinedState
+	jc.ReadInto(&imu, true)
+	if imu.Gyro != jcpc.GyroZero {
+		gyro := imu.Gyro
+		s.broadcast(Event{
+			Type:   EventIMU,
+			Player: pNum,
+			Serial: jc.Serial(),
+			IMU:    &gyro,
+		})
+	}
+}